@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io"
+	"bytes"
+	"errors"
+	"strconv"
+	"encoding/json"
+	"encoding/binary"
+)
+
+/*
+Compact encoding selected by websocket subprotocol. Frame layout, numbers are uvarints:
+
+	version, kind, id, cid, flags, seq
+	points: players, then for each: cid, count, x y...
+	areas: players, then for each: cid, contours, then for each contour:
+		count << 1 | packed, first x y, then either count - 1 directions (two per byte) if packed or x y...
+	moves: count, then for each: no, cid, pass | preset << 1, x, y
+	rest of the message as JSON
+*/
+const BinaryProtocol = "dots.binary.v1"
+
+var ErrMalformed = errors.New("malformed message")
+
+type binaryWriter struct {
+	bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.Write(w.tmp[:n])
+}
+
+func (w *binaryWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) point(p Point) {
+	w.uvarint(uint64(p.X))
+	w.uvarint(uint64(p.Y))
+}
+
+/* Direction between 8-connected contour nodes, -1 if they aren't neighbours */
+func direction(from, to Point) int {
+	dx, dy := int(to.X) - int(from.X), int(to.Y) - int(from.Y)
+	for d, n := range neighbours {
+		if n[0] == dx && n[1] == dy {return d}
+	}
+	return -1
+}
+
+func (w *binaryWriter) contour(points []Point) {
+	packed := len(points) > 0
+	for i := 1; i < len(points) && packed; i++ {
+		packed = direction(points[i - 1], points[i]) >= 0
+	}
+
+	if !packed {
+		w.uvarint(uint64(len(points)) << 1)
+		for _, p := range points {
+			w.point(p)
+		}
+		return
+	}
+
+	w.uvarint(uint64(len(points)) << 1 | 1)
+	w.point(points[0])
+
+	var b byte
+	for i := 1; i < len(points); i++ {
+		d := byte(direction(points[i - 1], points[i]))
+		if i & 1 != 0 {
+			b = d
+		} else {
+			w.WriteByte(b | d << 4)
+		}
+	}
+	if len(points) & 1 == 0 {
+		w.WriteByte(b)
+	}
+}
+
+func encodeBinary(msg *GameMessage, version uint) ([]byte, error) {
+	var w binaryWriter
+
+	w.uvarint(uint64(version))
+	w.str(msg.Kind())
+	w.str(msg.ID)
+	w.uvarint(msg.CID)
+	w.uvarint(uint64(msg.Flags))
+	w.uvarint(msg.Seq)
+
+	w.uvarint(uint64(len(msg.Points)))
+	for id, points := range msg.Points {
+		cid, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {return nil, err}
+
+		w.uvarint(cid)
+		w.uvarint(uint64(len(points)))
+		for _, p := range points {
+			w.point(p)
+		}
+	}
+
+	w.uvarint(uint64(len(msg.Areas)))
+	for id, areas := range msg.Areas {
+		cid, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {return nil, err}
+
+		w.uvarint(cid)
+		w.uvarint(uint64(len(areas)))
+		for _, contour := range areas {
+			w.contour(contour)
+		}
+	}
+
+	w.uvarint(uint64(len(msg.Moves)))
+	for _, m := range msg.Moves {
+		var fl uint64
+		if m.Pass {fl |= 1}
+		if m.Preset {fl |= 2}
+
+		w.uvarint(uint64(m.No))
+		w.uvarint(m.CID)
+		w.uvarint(fl)
+		w.point(m.Point)
+	}
+
+	/* everything else */
+	rest := *msg
+	rest.Points, rest.Areas, rest.Moves = nil, nil, nil
+	rest.CID, rest.Flags, rest.Seq, rest.ID = 0, 0, 0, ""
+
+	data, err := json.Marshal(&rest)
+	if err != nil {return nil, err}
+	w.Write(data)
+
+	return w.Bytes(), nil
+}
+
+type binaryReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {return 0}
+
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		r.err = ErrMalformed
+	}
+	return v
+}
+
+/* Count of items which take at least a byte each, can't exceed what is left */
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(r.Len()) {
+		r.err = ErrMalformed
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) str() string {
+	buf := make([]byte, r.count())
+	if _, err := io.ReadFull(r, buf); err != nil && r.err == nil {
+		r.err = ErrMalformed
+	}
+	return string(buf)
+}
+
+func (r *binaryReader) point() Point {
+	return Point{uint(r.uvarint()), uint(r.uvarint())}
+}
+
+func (r *binaryReader) contour() []Point {
+	head := r.uvarint()
+	n := int(head >> 1)
+	if r.err != nil || n > r.Len() * 2 + 1 {
+		r.err = ErrMalformed
+		return nil
+	}
+
+	points := make([]Point, 0, n)
+	if head & 1 == 0 {
+		for i := 0; i < n && r.err == nil; i++ {
+			points = append(points, r.point())
+		}
+		return points
+	}
+
+	if n == 0 {
+		r.err = ErrMalformed
+		return nil
+	}
+	p := r.point()
+	points = append(points, p)
+
+	var b byte
+	for i := 1; i < n && r.err == nil; i++ {
+		var d byte
+		if i & 1 != 0 {
+			var err error
+			if b, err = r.ReadByte(); err != nil {
+				r.err = ErrMalformed
+				break
+			}
+			d = b & 0xf
+		} else {
+			d = b >> 4
+		}
+		if d > 7 || (neighbours[d][0] < 0 && p.X == 0) || (neighbours[d][1] < 0 && p.Y == 0) {
+			r.err = ErrMalformed
+			break
+		}
+
+		p = Point{uint(int(p.X) + neighbours[d][0]), uint(int(p.Y) + neighbours[d][1])}
+		points = append(points, p)
+	}
+	return points
+}
+
+/* Parse binary message, returns envelope fields for the kind and version checks */
+func decodeBinaryMessage(data []byte) (*Envelope, *GameMessage, error) {
+	r := binaryReader{Reader: bytes.NewReader(data)}
+
+	env := Envelope {
+		Version: uint(r.uvarint()),
+		Type: r.str(),
+		ID: r.str(),
+	}
+	msg := GameMessage {
+		CID: r.uvarint(),
+		Flags: uint(r.uvarint()),
+		Seq: r.uvarint(),
+	}
+
+	if n := r.count(); n != 0 {
+		msg.Points = make(map[string][]Point)
+		for i := 0; i < n && r.err == nil; i++ {
+			id := formatCID(r.uvarint())
+			points := make([]Point, r.count())
+			for j := range points {
+				points[j] = r.point()
+			}
+			msg.Points[id] = points
+		}
+	}
+
+	if n := r.count(); n != 0 {
+		msg.Areas = make(map[string][][]Point)
+		for i := 0; i < n && r.err == nil; i++ {
+			id := formatCID(r.uvarint())
+			areas := make([][]Point, r.count())
+			for j := range areas {
+				areas[j] = r.contour()
+			}
+			msg.Areas[id] = areas
+		}
+	}
+
+	if n := r.count(); n != 0 {
+		msg.Moves = make([]Move, n)
+		for i := range msg.Moves {
+			m := &msg.Moves[i]
+			m.No = uint(r.uvarint())
+			m.CID = r.uvarint()
+			fl := r.uvarint()
+			m.Pass, m.Preset = fl & 1 != 0, fl & 2 != 0
+			m.Point = r.point()
+		}
+	}
+
+	if r.err != nil {return &env, nil, r.err}
+
+	/* rest is JSON */
+	rest := GameMessage{}
+	if r.Len() != 0 {
+		if err := json.NewDecoder(r).Decode(&rest); err != nil {return &env, nil, ErrMalformed}
+	}
+	rest.kind = env.Type
+	rest.ID = env.ID
+	rest.CID, rest.Flags, rest.Seq = msg.CID, msg.Flags, msg.Seq
+	rest.Points, rest.Areas, rest.Moves = msg.Points, msg.Areas, msg.Moves
+
+	return &env, &rest, nil
+}
+
+/* Client message in binary encoding, checked the same way as JSON envelope */
+func decodeBinary(data []byte) (*Envelope, *GameMessage, error) {
+	env, msg, err := decodeBinaryMessage(data)
+	if err != nil {return env, nil, err}
+
+	/* kind must match contents */
+	msg.kind = ""
+	return checkEnvelope(env, msg)
+}
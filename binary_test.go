@@ -0,0 +1,161 @@
+package main
+
+import (
+	"time"
+	"testing"
+	"encoding/json"
+)
+
+var codecTime = time.Date(2015, time.March, 1, 12, 30, 15, 0, time.UTC)
+
+/* Every field is set by some message, contours of both encodings are included */
+var codecMessages = []struct {
+	name string
+	msg *GameMessage
+}{
+	{"empty", &GameMessage{}},
+	{"keepalive", &GameMessage{Flags: FlagKeepAlive}},
+	{
+		name: "move",
+		msg: &GameMessage {
+			CID: 1,
+			ID: "c17",
+			Seq: 42,
+			Points: map[string][]Point{"1": {{4, 5}}},
+			Areas: map[string][][]Point {
+				"1": {ring2(4, 4), ring1(8, 8), {{3, 3}}, {{1, 1}, {2, 2}, {1, 2}}},
+				"2": {{{0, 0}, {5, 5}, {0, 7}}, {}},
+			},
+			Moves: []Move{{No: 7, CID: 1, Point: Point{4, 5}}},
+			Score: map[string]uint{"1": 3, "2": 0},
+			Captures: map[string]map[string]uint{"1": {"2": 2, "3": 1}, "3": {"1": 4}},
+			Eliminated: []string{"2"},
+			Turn: "3",
+			Clock: &Clock {
+				Remaining: map[string]int64{"1": 59000, "2": 0, "3": 1500},
+				Running: "3",
+				Started: codecTime,
+			},
+			Offers: &Offers{},
+		},
+	},
+	{
+		name: "history",
+		msg: &GameMessage {
+			kind: KindHistory,
+			Seq: 100,
+			Flags: FlagReset,
+			Players: map[string]string{"1": "red", "2": "blue", "3": ""},
+			Presence: map[string]bool{"1": true, "3": true},
+			Spectators: map[string]bool{"9": true},
+			Leave: []uint64{2},
+			Moves: []Move {
+				{CID: 1, Point: Point{10, 10}, Preset: true},
+				{CID: 3, Point: Point{11, 11}, Preset: true},
+				{No: 1, CID: 1, Point: Point{0, 29}},
+				{No: 2, CID: 3, Pass: true},
+				{No: 300, CID: 1 << 40, Point: Point{99, 99}},
+			},
+			Settings: &RoomSettings {
+				Width: 40,
+				Height: 30,
+				Players: 3,
+				Rules: "territory",
+				EmptyBase: EmptyBaseForbid,
+				Start: StartCross,
+				Clock: &TimeControl{Mode: ClockFischer, Base: 300, Increment: 5},
+				Spectators: true,
+			},
+			Result: &GameResult {
+				Winner: "1",
+				Score: map[string]uint{"1": 12, "3": 4},
+				Ranking: []string{"1", "3", "2"},
+				Reason: ReasonAgreement,
+				Grounded: 2,
+				Finished: codecTime,
+			},
+			Offers: &Offers {
+				Stop: []string{"1"},
+				Undo: &Offer{From: "3"},
+				Draw: &Offer{From: "1", Accepted: []string{"3"}},
+			},
+			Chat: []ChatMessage{{ID: 5, CID: 9, Text: "hi", Time: codecTime}},
+		},
+	},
+	{"action", &GameMessage{CID: 2, ID: "a", Action: ActionDraw}},
+	{"chat", &GameMessage{CID: 2, Chat: []ChatMessage{{Text: "gg"}}}},
+	{"error", &GameMessage{CID: 2, Error: ErrNotYourTurn.Error(), Code: ErrCodeIllegal, Ref: "c18"}},
+}
+
+func jsonRoundTrip(msg *GameMessage) (string, *GameMessage, error) {
+	env, err := encodeMessage(msg, ProtocolVersion)
+	if err != nil {return "", nil, err}
+
+	data, err := json.Marshal(env)
+	if err != nil {return "", nil, err}
+
+	var decoded Envelope
+	if err := json.Unmarshal(data, &decoded); err != nil {return "", nil, err}
+
+	result := new(GameMessage)
+	if err := json.Unmarshal(decoded.Payload, result); err != nil {return "", nil, err}
+
+	return decoded.Type, result, nil
+}
+
+func binaryRoundTrip(msg *GameMessage) (string, *GameMessage, error) {
+	data, err := encodeBinary(msg, ProtocolVersion)
+	if err != nil {return "", nil, err}
+
+	env, result, err := decodeBinaryMessage(data)
+	if err != nil {return "", nil, err}
+
+	if env.Version != ProtocolVersion || env.ID != msg.ID {return "", nil, ErrMalformed}
+	return env.Type, result, nil
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []struct {
+		name string
+		roundTrip func(*GameMessage) (string, *GameMessage, error)
+	}{
+		{"json", jsonRoundTrip},
+		{"binary", binaryRoundTrip},
+	}
+
+	for _, tt := range codecMessages {
+		want, err := json.Marshal(tt.msg)
+		if err != nil {t.Fatal(err)}
+
+		for _, c := range codecs {
+			kind, result, err := c.roundTrip(tt.msg)
+			if err != nil {
+				t.Errorf("%s %s: %v", c.name, tt.name, err)
+				continue
+			}
+
+			if kind != tt.msg.Kind() {
+				t.Errorf("%s %s: got kind %q, want %q", c.name, tt.name, kind, tt.msg.Kind())
+			}
+
+			got, err := json.Marshal(result)
+			if err != nil {t.Fatal(err)}
+
+			if string(got) != string(want) {
+				t.Errorf("%s %s:\ngot  %s\nwant %s", c.name, tt.name, got, want)
+			}
+		}
+	}
+}
+
+/* Truncated frames must not crash the decoder */
+func TestBinaryTruncated(t *testing.T) {
+	for _, tt := range codecMessages {
+		data, err := encodeBinary(tt.msg, ProtocolVersion)
+		if err != nil {t.Fatal(err)}
+
+		for n := 0; n < len(data); n++ {
+			decodeBinaryMessage(data[:n])
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"sort"
+	"errors"
+	"strconv"
+)
+
+/* Default grid size */
+const (
+	defaultBoardWidth = 40
+	defaultBoardHeight = 30
+)
+
+/* Empty base modes */
+const (
+	EmptyBaseNone = ""
+	EmptyBaseForbid = "forbid" /* enemy can't play inside */
+	EmptyBaseCapture = "capture" /* enemy dot played inside is captured at once */
+)
+
+var (
+	ErrOutOfBoard = errors.New("point is out of board")
+	ErrOccupied = errors.New("node is occupied")
+	ErrInsideBase = errors.New("node is inside enemy base")
+	ErrInsideArea = errors.New("node is inside captured area")
+)
+
+/* Authoritative board state, owned by GameServer goroutine */
+type Board struct {
+	Width uint
+	Height uint
+	rules Ruleset
+	emptyBase string
+
+	nodes []uint64 /* cid of the dot at node, 0 if free */
+	owner []uint64 /* cid of the player whose area covers node, 0 if none */
+	base []uint64 /* cid of the player whose empty base covers node, 0 if none */
+	regions []*region
+	bases []*region
+	cids map[uint64]bool
+	playable map[uint64]int /* nodes before it are known to be illegal for cid */
+}
+
+/* Captured region or empty base */
+type region struct {
+	cid uint64
+	nodes []int
+	contour []Point
+}
+
+/* Clockwise neighbours starting from north, same as VacuumWrap.revHourMap */
+var neighbours = [8][2]int {
+	{ 0, -1},
+	{+1, -1},
+	{+1,  0},
+	{+1, +1},
+	{ 0, +1},
+	{-1, +1},
+	{-1,  0},
+	{-1, -1},
+}
+
+func NewBoard(width, height uint, rules Ruleset, emptyBase string) *Board {
+	return &Board {
+		Width: width,
+		Height: height,
+		rules: rules,
+		emptyBase: emptyBase,
+		nodes: make([]uint64, width * height),
+		owner: make([]uint64, width * height),
+		base: make([]uint64, width * height),
+		cids: make(map[uint64]bool),
+		playable: make(map[uint64]int),
+	}
+}
+
+func (b *Board) Inside(p Point) bool {
+	return p.X < b.Width && p.Y < b.Height
+}
+
+func (b *Board) index(p Point) int {
+	return int(p.Y * b.Width + p.X)
+}
+
+/* Owner of the dot at p, 0 if none */
+func (b *Board) At(p Point) uint64 {
+	if !b.Inside(p) {return 0}
+	return b.nodes[b.index(p)]
+}
+
+func (b *Board) CanPlace(p Point) error {
+	if !b.Inside(p) {return ErrOutOfBoard}
+	if b.nodes[b.index(p)] != 0 {return ErrOccupied}
+	return nil
+}
+
+/* Full legality check of cid's dot at p */
+func (b *Board) check(cid uint64, p Point) error {
+	if err := b.CanPlace(p); err != nil {return err}
+	if err := b.rules.CanPlace(b, cid, p); err != nil {return err}
+
+	idx := b.index(p)
+	if b.owner[idx] != 0 {return ErrInsideArea}
+	if b.emptyBase == EmptyBaseForbid && b.base[idx] != 0 && b.base[idx] != cid {return ErrInsideBase}
+	return nil
+}
+
+/* Whether cid has at least one legal move. Illegal node stays such until a base is dissolved,
+so the scan goes on from the node found last time. */
+func (b *Board) Playable(cid uint64) bool {
+	idx := b.playable[cid]
+	for idx < len(b.nodes) && b.check(cid, b.point(idx)) != nil {
+		idx++
+	}
+	b.playable[cid] = idx
+	return idx < len(b.nodes)
+}
+
+/* Put dot and run capture detection. Returns cids whose areas were changed. */
+func (b *Board) Place(cid uint64, p Point) ([]uint64, error) {
+	if err := b.check(cid, p); err != nil {return nil, err}
+	return b.place(cid, p), nil
+}
+
+/* Put stored dot. Old records may have dots inside areas, they stay captured or dead as they were. */
+func (b *Board) Replay(cid uint64, p Point) ([]uint64, error) {
+	if err := b.check(cid, p); err != nil && err != ErrInsideArea {return nil, err}
+	return b.place(cid, p), nil
+}
+
+func (b *Board) place(cid uint64, p Point) []uint64 {
+	idx := b.index(p)
+	enemyBase := b.base[idx] != 0 && b.base[idx] != cid
+
+	b.nodes[idx] = cid
+	b.cids[cid] = true
+
+	changed := make(map[uint64]bool)
+
+	/* base owner takes the dot before anything else */
+	if enemyBase && b.emptyBase == EmptyBaseCapture {
+		enemy := b.base[idx]
+		if nodes, closed := b.fill(enemy, idx, make([]bool, len(b.nodes))); closed {
+			b.enclose(enemy, nodes, changed)
+			return changedList(changed)
+		}
+	}
+
+	/* mover captures first */
+	visited := make([]bool, len(b.nodes))
+	for d := 0; d < 8; d += 2 {
+		n, ok := b.neighbour(idx, d)
+		if !ok || visited[n] || b.active(n, cid) {continue}
+
+		nodes, closed := b.fill(cid, n, visited)
+		if !closed {continue}
+
+		if b.rules.Capture(b, cid, nodes) {
+			b.enclose(cid, nodes, changed)
+		} else if b.emptyBase != EmptyBaseNone {
+			b.addBase(cid, nodes, changed)
+		}
+	}
+
+	/* new dot may be surrounded by somebody else */
+	if len(changed) == 0 {
+		for _, enemy := range b.players() {
+			if enemy == cid || !b.active(idx, cid) {continue}
+
+			nodes, closed := b.fill(enemy, idx, make([]bool, len(b.nodes)))
+			if closed && b.rules.Capture(b, enemy, nodes) {
+				b.enclose(enemy, nodes, changed)
+			}
+		}
+	}
+
+	return changedList(changed)
+}
+
+func changedList(changed map[uint64]bool) []uint64 {
+	result := make([]uint64, 0, len(changed))
+	for c := range changed {
+		result = append(result, c)
+	}
+	return result
+}
+
+/* Areas of given player in wire format. Forbidden bases are shown as areas too. */
+func (b *Board) Areas(cid uint64) [][]Point {
+	areas := [][]Point{}
+	for _, r := range b.regions {
+		if r.cid == cid {
+			areas = append(areas, r.contour)
+		}
+	}
+
+	if b.emptyBase == EmptyBaseForbid {
+		for _, r := range b.bases {
+			if r.cid == cid {
+				areas = append(areas, r.contour)
+			}
+		}
+	}
+
+	return areas
+}
+
+/* Number of empty nodes outside of areas */
+func (b *Board) Free() uint {
+	var n uint
+	for idx, cid := range b.nodes {
+		if cid == 0 && b.owner[idx] == 0 {n++}
+	}
+	return n
+}
+
+/* Enemy dots inside cid's areas */
+func (b *Board) Captured(cid uint64) uint {
+	var n uint
+	for idx, owner := range b.owner {
+		if owner == cid && b.nodes[idx] != 0 && b.nodes[idx] != cid {n++}
+	}
+	return n
+}
+
+/* Dots of victim inside cid's areas */
+func (b *Board) CapturedFrom(cid, victim uint64) uint {
+	var n uint
+	for idx, owner := range b.owner {
+		if owner == cid && b.nodes[idx] == victim && victim != cid {n++}
+	}
+	return n
+}
+
+/* Number of active dots of cid not connected to the board edge through other active dots */
+func (b *Board) Ungrounded(cid uint64) uint {
+	return uint(len(b.ungrounded(cid)))
+}
+
+/* Copy for final scoring where cid's ungrounded dots are inside opponent's area */
+func (b *Board) Grounded(cid, opponent uint64) *Board {
+	grounded := *b
+	grounded.owner = append([]uint64(nil), b.owner...)
+	grounded.playable = make(map[uint64]int)
+
+	for _, idx := range b.ungrounded(cid) {
+		grounded.owner[idx] = opponent
+	}
+	return &grounded
+}
+
+func (b *Board) ungrounded(cid uint64) []int {
+	grounded := make([]bool, len(b.nodes))
+	queue := []int{}
+
+	for idx := range b.nodes {
+		if b.onEdge(idx) && b.active(idx, cid) {
+			grounded[idx] = true
+			queue = append(queue, idx)
+		}
+	}
+
+	/* chains are 8-connected */
+	for i := 0; i < len(queue); i++ {
+		for d := 0; d < 8; d++ {
+			n, ok := b.neighbour(queue[i], d)
+			if ok && !grounded[n] && b.active(n, cid) {
+				grounded[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	nodes := []int{}
+	for idx := range b.nodes {
+		if b.active(idx, cid) && !grounded[idx] {
+			nodes = append(nodes, idx)
+		}
+	}
+	return nodes
+}
+
+/* Nodes covered by cid's areas */
+func (b *Board) Territory(cid uint64) uint {
+	var n uint
+	for _, owner := range b.owner {
+		if owner == cid {n++}
+	}
+	return n
+}
+
+func (b *Board) AllAreas() map[string][][]Point {
+	areas := make(map[string][][]Point)
+	for cid := range b.cids {
+		if a := b.Areas(cid); len(a) != 0 {
+			areas[strconv.FormatUint(cid, 10)] = a
+		}
+	}
+	return areas
+}
+
+type cidSlice []uint64
+
+func (s cidSlice) Len() int {return len(s)}
+func (s cidSlice) Less(i, j int) bool {return s[i] < s[j]}
+func (s cidSlice) Swap(i, j int) {s[i], s[j] = s[j], s[i]}
+
+/* Sorted for deterministic replay */
+func (b *Board) players() []uint64 {
+	cids := make([]uint64, 0, len(b.cids))
+	for cid := range b.cids {
+		cids = append(cids, cid)
+	}
+	sort.Sort(cidSlice(cids))
+	return cids
+}
+
+func (b *Board) point(idx int) Point {
+	return Point{uint(idx) % b.Width, uint(idx) / b.Width}
+}
+
+func (b *Board) neighbour(idx int, dir int) (int, bool) {
+	x := idx % int(b.Width) + neighbours[dir][0]
+	y := idx / int(b.Width) + neighbours[dir][1]
+
+	if x < 0 || y < 0 || x >= int(b.Width) || y >= int(b.Height) {return 0, false}
+	return y * int(b.Width) + x, true
+}
+
+func (b *Board) onEdge(idx int) bool {
+	x, y := uint(idx) % b.Width, uint(idx) / b.Width
+	return x == 0 || y == 0 || x == b.Width - 1 || y == b.Height - 1
+}
+
+/* Dot of given player which is not captured */
+func (b *Board) active(idx int, cid uint64) bool {
+	return b.nodes[idx] == cid && (b.owner[idx] == 0 || b.owner[idx] == cid)
+}
+
+/* Collect 4-connected nodes not blocked by cid's active dots. Region is closed if it doesn't touch the edge. */
+func (b *Board) fill(cid uint64, start int, visited []bool) ([]int, bool) {
+	closed := true
+	nodes := []int{start}
+	visited[start] = true
+
+	for i := 0; i < len(nodes); i++ {
+		idx := nodes[i]
+		if b.onEdge(idx) {closed = false}
+
+		for d := 0; d < 8; d += 2 {
+			n, ok := b.neighbour(idx, d)
+			if ok && !visited[n] && !b.active(n, cid) {
+				visited[n] = true
+				nodes = append(nodes, n)
+			}
+		}
+	}
+
+	return nodes, closed
+}
+
+func (b *Board) hasEnemies(cid uint64, nodes []int) bool {
+	for _, idx := range nodes {
+		if b.nodes[idx] != 0 && b.active(idx, b.nodes[idx]) && b.nodes[idx] != cid {return true}
+	}
+	return false
+}
+
+/* Whether any node or wall dot of the region is inside */
+func (b *Board) overlaps(r *region, inside []bool) bool {
+	for _, idx := range r.nodes {
+		if inside[idx] {return true}
+	}
+	for _, p := range r.contour {
+		if inside[b.index(p)] {return true}
+	}
+	return false
+}
+
+/* Mark nodes of remaining bases. Nodes of dissolved ones may be played again. */
+func (b *Board) markBases() {
+	b.playable = make(map[uint64]int)
+
+	for idx := range b.base {
+		b.base[idx] = 0
+	}
+	for _, r := range b.bases {
+		for _, idx := range r.nodes {
+			b.base[idx] = r.cid
+		}
+	}
+}
+
+/* Turn region into cid's area. Areas inside it and bases losing any node or wall dot to it are dissolved. */
+func (b *Board) enclose(cid uint64, nodes []int, changed map[uint64]bool) {
+	inside := make([]bool, len(b.nodes))
+	for _, idx := range nodes {
+		inside[idx] = true
+	}
+
+	regions := b.regions[:0]
+	for _, r := range b.regions {
+		if b.overlaps(r, inside) {
+			changed[r.cid] = true
+		} else {
+			regions = append(regions, r)
+		}
+	}
+	b.regions = regions
+
+	bases := b.bases[:0]
+	for _, r := range b.bases {
+		if b.overlaps(r, inside) {
+			if b.emptyBase == EmptyBaseForbid {
+				changed[r.cid] = true
+			}
+		} else {
+			bases = append(bases, r)
+		}
+	}
+	b.bases = bases
+	b.markBases()
+
+	for _, idx := range nodes {
+		b.owner[idx] = cid
+	}
+
+	b.regions = append(b.regions, &region {
+		cid: cid,
+		nodes: nodes,
+		contour: b.contour(cid, inside),
+	})
+	changed[cid] = true
+}
+
+/* Remember closed region without enemies as cid's empty base */
+func (b *Board) addBase(cid uint64, nodes []int, changed map[uint64]bool) {
+	known := true
+	inside := make([]bool, len(b.nodes))
+	for _, idx := range nodes {
+		inside[idx] = true
+		if b.base[idx] != cid && b.owner[idx] != cid {
+			known = false
+		}
+	}
+
+	/* already own base or area */
+	if known {return}
+
+	r := &region {
+		cid: cid,
+		nodes: nodes,
+		contour: b.contour(cid, inside),
+	}
+
+	/* own bases enclosed by the new one become its part, so only the outer contour is shown */
+	bases := b.bases[:0]
+	for _, s := range b.bases {
+		if s.cid == cid && enclosed(b.point(s.nodes[0]), r.contour) {
+			r.nodes = append(r.nodes, s.nodes...)
+		} else {
+			bases = append(bases, s)
+		}
+	}
+	b.bases = append(bases, r)
+	b.markBases()
+
+	if b.emptyBase == EmptyBaseForbid {
+		changed[cid] = true
+	}
+}
+
+/* Moore neighbour tracing of region together with its border. Only border dots are ever visited. */
+func (b *Board) contour(cid uint64, inside []bool) []Point {
+	shape := make([]bool, len(b.nodes))
+	start := -1
+	size := 0
+
+	for idx := range inside {
+		if !inside[idx] {continue}
+		shape[idx] = true
+		size++
+
+		for d := 0; d < 8; d += 2 {
+			if n, ok := b.neighbour(idx, d); ok && b.active(n, cid) && !shape[n] {
+				shape[n] = true
+				size++
+			}
+		}
+	}
+
+	for idx := range shape {
+		if shape[idx] {
+			start = idx
+			break
+		}
+	}
+
+	/* returns next node and direction from it to the backtrack node */
+	step := func(idx, back int) (int, int) {
+		x, y := idx % int(b.Width), idx / int(b.Width)
+
+		for i := 1; i <= 8; i++ {
+			d := (back + i) & 7
+			if n, ok := b.neighbour(idx, d); ok && shape[n] {
+				prev := neighbours[(d - 1) & 7]
+				dx := x + prev[0] - n % int(b.Width)
+				dy := y + prev[1] - n / int(b.Width)
+
+				for nd := range neighbours {
+					if neighbours[nd][0] == dx && neighbours[nd][1] == dy {
+						return n, nd
+					}
+				}
+			}
+		}
+		return idx, back
+	}
+
+	/* topmost-leftmost node, west is always free. Jacob's stopping criterion. */
+	second, back := step(start, 6)
+	contour := []Point{b.point(start)}
+	idx := second
+
+	for i := 0; i < size * 4; i++ {
+		if idx == start {
+			if n, _ := step(idx, back); n == second {break}
+		}
+		contour = append(contour, b.point(idx))
+		idx, back = step(idx, back)
+	}
+
+	return contour
+}
+
+/* Whether p lies inside closed contour, p must not be on it */
+func enclosed(p Point, contour []Point) bool {
+	in := false
+	for i := range contour {
+		a, c := contour[i], contour[(i + 1) % len(contour)]
+		if (a.Y > p.Y) == (c.Y > p.Y) {continue}
+
+		/* crossing of the edge with the ray going east from p */
+		x := float64(a.X) + float64(int(p.Y) - int(a.Y)) * float64(int(c.X) - int(a.X)) / float64(int(c.Y) - int(a.Y))
+		if float64(p.X) < x {
+			in = !in
+		}
+	}
+	return in
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"testing"
+)
+
+type boardMove struct {
+	cid uint64
+	p Point
+}
+
+/* Dots of one player in given order */
+func dots(cid uint64, points ...Point) []boardMove {
+	moves := make([]boardMove, len(points))
+	for i, p := range points {
+		moves[i] = boardMove{cid, p}
+	}
+	return moves
+}
+
+func join(parts ...[]boardMove) []boardMove {
+	moves := []boardMove{}
+	for _, p := range parts {
+		moves = append(moves, p...)
+	}
+	return moves
+}
+
+/* Diamond of radius 1 and 2 around (x, y) */
+func ring1(x, y uint) []Point {
+	return []Point{{x, y - 1}, {x + 1, y}, {x, y + 1}, {x - 1, y}}
+}
+
+func ring2(x, y uint) []Point {
+	return []Point{{x, y - 2}, {x + 1, y - 1}, {x + 2, y}, {x + 1, y + 1}, {x, y + 2}, {x - 1, y + 1}, {x - 2, y}, {x - 1, y - 1}}
+}
+
+/* Outline of the square in clockwise order */
+func square(x0, y0, x1, y1 uint) []Point {
+	points := []Point{}
+	for x := x0; x < x1; x++ {
+		points = append(points, Point{x, y0})
+	}
+	for y := y0; y < y1; y++ {
+		points = append(points, Point{x1, y})
+	}
+	for x := x1; x > x0; x-- {
+		points = append(points, Point{x, y1})
+	}
+	for y := y1; y > y0; y-- {
+		points = append(points, Point{x0, y})
+	}
+	return points
+}
+
+type boardTest struct {
+	name string
+	rules Ruleset /* classic if nil */
+	emptyBase string
+	moves []boardMove /* the last one must fail with err, the rest must succeed */
+	err error
+	captured map[uint64]uint
+	areas map[uint64]int
+	score map[uint64]uint
+}
+
+var boardTests = []boardTest {
+	{
+		name: "simple capture",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring1(4, 4)...)),
+		captured: map[uint64]uint{1: 1, 2: 0},
+		areas: map[uint64]int{1: 1, 2: 0},
+	},
+	{
+		name: "capture with walls on the edge",
+		moves: join(dots(2, Point{1, 1}), dots(1, ring1(1, 1)...)),
+		captured: map[uint64]uint{1: 1},
+		areas: map[uint64]int{1: 1},
+	},
+	{
+		name: "dot on the edge is never captured",
+		moves: join(dots(2, Point{0, 1}), dots(1, Point{0, 0}, Point{1, 1}, Point{0, 2})),
+		captured: map[uint64]uint{1: 0},
+		areas: map[uint64]int{1: 0},
+	},
+	{
+		name: "empty enclosure doesn't capture",
+		moves: dots(1, ring1(4, 4)...),
+		captured: map[uint64]uint{1: 0},
+		areas: map[uint64]int{1: 0},
+	},
+	{
+		name: "dot played into enclosure is captured",
+		moves: join(dots(1, ring1(4, 4)...), dots(2, Point{4, 4})),
+		captured: map[uint64]uint{1: 1},
+		areas: map[uint64]int{1: 1},
+	},
+	{
+		name: "nested areas, outer one swallows inner",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring1(4, 4)...), dots(2, ring2(4, 4)...)),
+		captured: map[uint64]uint{1: 0, 2: 4},
+		areas: map[uint64]int{1: 0, 2: 1},
+	},
+	{
+		name: "enemy dot inside area",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...), dots(2, Point{4, 3})),
+		err: ErrInsideArea,
+		captured: map[uint64]uint{1: 1},
+		areas: map[uint64]int{1: 1},
+	},
+	{
+		name: "own dot inside area",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...), dots(1, Point{5, 4})),
+		err: ErrInsideArea,
+		captured: map[uint64]uint{1: 1},
+		areas: map[uint64]int{1: 1},
+	},
+	{
+		name: "recaptured dots revive",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...), dots(2, square(1, 1, 7, 7)...)),
+		captured: map[uint64]uint{1: 0, 2: 8},
+		areas: map[uint64]int{1: 0, 2: 1},
+	},
+	{
+		name: "enemy dot inside recaptured area",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...), dots(2, square(1, 1, 7, 7)...), dots(1, Point{4, 3})),
+		err: ErrInsideArea,
+		captured: map[uint64]uint{1: 0, 2: 8},
+	},
+	{
+		name: "own dot inside recaptured area",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...), dots(2, square(1, 1, 7, 7)...), dots(2, Point{4, 3})),
+		err: ErrInsideArea,
+		captured: map[uint64]uint{1: 0, 2: 8},
+	},
+	{
+		name: "area recaptured back",
+		moves: join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...), dots(2, square(1, 1, 7, 7)...), dots(1, square(0, 0, 8, 8)...)),
+		captured: map[uint64]uint{1: 25, 2: 0},
+		areas: map[uint64]int{1: 1, 2: 0},
+	},
+	{
+		name: "territory: empty enclosure is taken",
+		rules: TerritoryRules{},
+		moves: join(dots(1, ring2(4, 4)...), dots(2, Point{4, 4})),
+		err: ErrInsideArea,
+		areas: map[uint64]int{1: 1},
+		score: map[uint64]uint{1: 5, 2: 0},
+	},
+	{
+		name: "territory: capture counts surrounded nodes",
+		rules: TerritoryRules{},
+		moves: join(dots(2, Point{4, 4}), dots(1, ring1(4, 4)...)),
+		captured: map[uint64]uint{1: 1},
+		score: map[uint64]uint{1: 1},
+	},
+	{
+		name: "empty base forbids enemy dots",
+		emptyBase: EmptyBaseForbid,
+		moves: join(dots(1, ring1(4, 4)...), dots(2, Point{4, 4})),
+		err: ErrInsideBase,
+		areas: map[uint64]int{1: 1, 2: 0},
+	},
+	{
+		name: "empty base captures enemy dot at once",
+		emptyBase: EmptyBaseCapture,
+		moves: join(dots(1, ring1(4, 4)...), dots(2, Point{4, 4})),
+		captured: map[uint64]uint{1: 1},
+		areas: map[uint64]int{1: 1},
+	},
+	{
+		name: "nested bases show the outer contour only",
+		emptyBase: EmptyBaseForbid,
+		moves: join(dots(1, square(3, 3, 5, 5)...), dots(1, square(1, 1, 7, 7)...), dots(2, Point{4, 4})),
+		err: ErrInsideBase,
+		areas: map[uint64]int{1: 1},
+	},
+	{
+		name: "enclosed base is dissolved",
+		emptyBase: EmptyBaseForbid,
+		moves: join(dots(1, square(3, 3, 5, 5)...), dots(2, square(1, 1, 7, 7)...)),
+		captured: map[uint64]uint{2: 8},
+		areas: map[uint64]int{1: 0, 2: 1},
+	},
+	{
+		name: "occupied node",
+		moves: join(dots(1, Point{4, 4}), dots(2, Point{4, 4})),
+		err: ErrOccupied,
+	},
+	{
+		name: "out of board",
+		moves: dots(1, Point{10, 4}),
+		err: ErrOutOfBoard,
+	},
+}
+
+func runBoardTest(t *testing.T, tt *boardTest) *Board {
+	rules := tt.rules
+	if rules == nil {
+		rules = ClassicRules{}
+	}
+	b := NewBoard(10, 10, rules, tt.emptyBase)
+
+	for i, m := range tt.moves {
+		_, err := b.Place(m.cid, m.p)
+
+		want := error(nil)
+		if i == len(tt.moves) - 1 {
+			want = tt.err
+		}
+		if err != want {
+			t.Errorf("%s: move %d %v: got error %v, want %v", tt.name, i, m.p, err, want)
+			return b
+		}
+	}
+
+	for cid, n := range tt.captured {
+		if got := b.Captured(cid); got != n {
+			t.Errorf("%s: player %d captured %d, want %d", tt.name, cid, got, n)
+		}
+	}
+	for cid, n := range tt.areas {
+		if got := len(b.Areas(cid)); got != n {
+			t.Errorf("%s: player %d has %d areas, want %d", tt.name, cid, got, n)
+		}
+	}
+	for cid, n := range tt.score {
+		if got := rules.Score(b, cid); got != n {
+			t.Errorf("%s: player %d score %d, want %d", tt.name, cid, got, n)
+		}
+	}
+	return b
+}
+
+func TestBoardPlace(t *testing.T) {
+	for i := range boardTests {
+		runBoardTest(t, &boardTests[i])
+	}
+}
+
+func TestBoardContour(t *testing.T) {
+	b := NewBoard(10, 10, ClassicRules{}, EmptyBaseNone)
+	for _, m := range join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...)) {
+		if _, err := b.Place(m.cid, m.p); err != nil {t.Fatal(err)}
+	}
+
+	/* clockwise from the topmost dot */
+	want := ring2(4, 4)
+	areas := b.Areas(1)
+	if len(areas) != 1 || len(areas[0]) != len(want) {t.Fatalf("got areas %v, want %v", areas, want)}
+	for i, p := range areas[0] {
+		if p != want[i] {t.Fatalf("got contour %v, want %v", areas[0], want)}
+	}
+}
+
+func TestBoardGrounded(t *testing.T) {
+	for _, rules := range []Ruleset{ClassicRules{}, TerritoryRules{}} {
+		b := NewBoard(10, 10, rules, EmptyBaseNone)
+		for _, m := range join(dots(1, Point{0, 5}, Point{1, 5}, Point{4, 4}), dots(2, Point{6, 6})) {
+			if _, err := b.Place(m.cid, m.p); err != nil {t.Fatal(err)}
+		}
+
+		if n := b.Ungrounded(1); n != 1 {t.Errorf("%T: %d ungrounded dots, want 1", rules, n)}
+
+		grounded := b.Grounded(1, 2)
+		if s := rules.Score(grounded, 2); s != 1 {t.Errorf("%T: opponent score %d, want 1", rules, s)}
+		if s := rules.Score(b, 2); s != 0 {t.Errorf("%T: board changed by grounding", rules)}
+	}
+}
+
+/* Stored dot inside an area is kept as it was played before such dots were refused */
+func TestBoardReplay(t *testing.T) {
+	b := NewBoard(10, 10, ClassicRules{}, EmptyBaseNone)
+	for _, m := range join(dots(2, Point{4, 4}), dots(1, ring2(4, 4)...)) {
+		if _, err := b.Place(m.cid, m.p); err != nil {t.Fatal(err)}
+	}
+
+	if _, err := b.Place(2, Point{4, 3}); err != ErrInsideArea {t.Fatalf("got error %v, want %v", err, ErrInsideArea)}
+	if _, err := b.Replay(2, Point{4, 3}); err != nil {t.Fatal(err)}
+	if _, err := b.Replay(2, Point{4, 3}); err != ErrOccupied {t.Fatalf("got error %v, want %v", err, ErrOccupied)}
+
+	if n := b.Captured(1); n != 2 {t.Errorf("captured %d, want 2", n)}
+}
+
+/* Cached scan must agree with the full one after every move */
+func TestBoardPlayable(t *testing.T) {
+	for _, tt := range boardTests {
+		rules := tt.rules
+		if rules == nil {
+			rules = ClassicRules{}
+		}
+		b := NewBoard(10, 10, rules, tt.emptyBase)
+
+		for _, m := range tt.moves {
+			b.Place(m.cid, m.p)
+
+			for cid := uint64(1); cid <= 2; cid++ {
+				want := false
+				for idx := range b.nodes {
+					if b.check(cid, b.point(idx)) == nil {
+						want = true
+						break
+					}
+				}
+				if got := b.Playable(cid); got != want {
+					t.Errorf("%s: player %d playable %t, want %t", tt.name, cid, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+	"errors"
+	"strings"
+)
+
+const (
+	maxChatLength = 500 /* bytes */
+	chatHistorySize = 50 /* messages sent with room history */
+	maxChatPage = 200
+)
+
+var ErrBadChat = errors.New("exactly one non-empty chat message expected")
+
+type ChatMessage struct {
+	ID uint64 `json:"id,omitempty"` /* assigned when stored */
+	CID uint64 `json:"cid"`
+	Text string `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+/* Check client chat message and fill in the author and time */
+func (c *ChatMessage) Prepare(cid uint64, now time.Time) error {
+	c.Text = strings.TrimSpace(c.Text)
+	if c.Text == "" || len(c.Text) > maxChatLength {return ErrBadChat}
+
+	c.ID = 0
+	c.CID = cid
+	c.Time = now
+	return nil
+}
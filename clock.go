@@ -0,0 +1,126 @@
+package main
+
+import (
+	"time"
+	"errors"
+)
+
+/* Time control modes */
+const (
+	ClockSuddenDeath = "sudden"
+	ClockFischer = "fischer" /* increment after each move */
+	ClockByoyomi = "byoyomi" /* fixed time per move after main time is over */
+)
+
+var ErrTimeControl = errors.New("bad time control")
+
+/* Chosen at room creation, all values in seconds */
+type TimeControl struct {
+	Mode string `json:"mode"`
+	Base uint `json:"base"`
+	Increment uint `json:"increment,omitempty"`
+	PerMove uint `json:"per_move,omitempty"`
+}
+
+func (tc *TimeControl) Check() error {
+	switch tc.Mode {
+	case ClockSuddenDeath, ClockFischer:
+		if tc.Base == 0 {return ErrTimeControl}
+	case ClockByoyomi:
+		if tc.PerMove == 0 {return ErrTimeControl}
+	default:
+		return ErrTimeControl
+	}
+	return nil
+}
+
+/* Persisted clock state, also sent to clients */
+type Clock struct {
+	Remaining map[string]int64 `json:"remaining"` /* main time left, ms */
+	Running string `json:"running,omitempty"` /* cid whose time is going */
+	Started time.Time `json:"started"` /* when running clock was started */
+
+	tc *TimeControl
+}
+
+func NewClock(tc *TimeControl) *Clock {
+	return &Clock {
+		Remaining: make(map[string]int64),
+		tc: tc,
+	}
+}
+
+/* Copy safe to pass to client goroutines */
+func (c *Clock) Snapshot() *Clock {
+	snap := *c
+	snap.Remaining = make(map[string]int64)
+	for id, left := range c.Remaining {
+		snap.Remaining[id] = left
+	}
+	return &snap
+}
+
+func (c *Clock) AddPlayer(cid uint64) {
+	if _, ok := c.Remaining[formatCID(cid)]; !ok {
+		c.Remaining[formatCID(cid)] = int64(c.tc.Base) * 1000
+	}
+}
+
+/* Moment the running player loses on time, zero if clock is stopped */
+func (c *Clock) Deadline() time.Time {
+	if c.Running == "" {return time.Time{}}
+
+	left := time.Duration(c.Remaining[c.Running]) * time.Millisecond
+	if c.tc.Mode == ClockByoyomi {
+		left += time.Duration(c.tc.PerMove) * time.Second
+	}
+
+	return c.Started.Add(left)
+}
+
+func (c *Clock) Expired(now time.Time) bool {
+	return c.Running != "" && !now.Before(c.Deadline())
+}
+
+/* Charge the mover and start the next player's time. Returns false on flag fall. */
+func (c *Clock) Punch(cid, next uint64, now time.Time) bool {
+	id := formatCID(cid)
+
+	if c.Running == id {
+		if c.Expired(now) {return false}
+
+		left := c.Remaining[id] - int64(now.Sub(c.Started) / time.Millisecond)
+
+		switch c.tc.Mode {
+		case ClockFischer:
+			left += int64(c.tc.Increment) * 1000
+		case ClockByoyomi:
+			/* period is restored after every move in time */
+			if left < 0 {left = 0}
+		}
+		c.Remaining[id] = left
+	}
+
+	c.Start(next, now)
+	return true
+}
+
+/* Charge the running player without increment and start the next one, the turn is given back */
+func (c *Clock) Switch(next uint64, now time.Time) {
+	if c.Running != "" {
+		left := c.Remaining[c.Running] - int64(now.Sub(c.Started) / time.Millisecond)
+		if left < 0 {left = 0}
+		c.Remaining[c.Running] = left
+	}
+
+	c.Start(next, now)
+}
+
+func (c *Clock) Start(cid uint64, now time.Time) {
+	c.Running = formatCID(cid)
+	c.Started = now
+}
+
+func (c *Clock) Stop() {
+	c.Running = ""
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"log"
+	"math"
 	"time"
 	"strconv"
 	"database/sql"
@@ -13,7 +14,8 @@ import (
 type DBProxy interface {
 	RoomId(uid string) (uint64, error)
 	RoomUID(id uint64) (string, error)
-	NewRoom(uid string) (uint64, error)
+	NewRoom(uid string, settings *RoomSettings) (uint64, error)
+	GetRoomSettings(roomId uint64) (*RoomSettings, error)
 
 	NewPlayer(roomId, cid uint64, scheme string) (uint64, error)
 	GetPlayer(roomId, cid uint64) (uint64, error)
@@ -23,6 +25,9 @@ type DBProxy interface {
 
 	PostHistory(msg *GameMessage) error
 	LoadHistory(id uint64) (*GameMessage, error)
+	DeleteLastMove(roomId uint64) error
+	SetSequence(roomId, seq uint64) error
+	GetChat(roomId, before uint64, limit uint) ([]ChatMessage, error)
 
 	LoadSession(sid, name string) (string, error)
 	SaveSession(sid, name string, data string) error
@@ -69,10 +74,33 @@ func (db *PQProxy) RoomUID(id uint64) (string, error) {
 	return uid, err
 }
 
-func (db *PQProxy) NewRoom(uid string) (uint64, error) {
+/* Room is created together with its starting position */
+func (db *PQProxy) NewRoom(uid string, settings *RoomSettings) (uint64, error) {
 	var roomId uint64
-	err := db.QueryRow("INSERT INTO room (uid) VALUES ($1) RETURNING id", uid).Scan(&roomId)
 
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("NewRoom: ", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	jsondata, _ := json.Marshal(settings)
+	err = tx.QueryRow("INSERT INTO room (uid, settings) VALUES ($1, $2) RETURNING id", uid, jsondata).Scan(&roomId)
+	if err != nil {
+		log.Println("NewRoom: ", err)
+		return 0, err
+	}
+
+	for _, p := range settings.StartPoints() {
+		_, err = tx.Exec("INSERT INTO point (room_id, seat, x, y) VALUES ($1, $2, $3, $4)", roomId, p.Seat, p.X, p.Y)
+		if err != nil {
+			log.Println("NewRoom: ", err)
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		log.Println("NewRoom: ", err)
 	}
@@ -80,42 +108,123 @@ func (db *PQProxy) NewRoom(uid string) (uint64, error) {
 	return roomId, err
 }
 
+func (db *PQProxy) GetRoomSettings(roomId uint64) (*RoomSettings, error) {
+	var data []byte
+	err := db.QueryRow("SELECT settings FROM room WHERE id = $1", roomId).Scan(&data)
+	if err != nil {
+		log.Println("GetRoomSettings: ", err)
+		return nil, err
+	}
+
+	settings := new(RoomSettings)
+	if data != nil {
+		if err = json.Unmarshal(data, settings); err != nil {return nil, err}
+	}
+
+	return settings, nil
+}
+
+/* Store room event at once, nothing is stored if any part fails */
 func (db *PQProxy) PostHistory(msg *GameMessage) error {
+	tx, err := db.Begin()
+	if err != nil {return err}
+	defer tx.Rollback()
+
 	/* Add or modify player */
 	for cid, scheme := range msg.Players {
-		res, err := db.Exec("UPDATE player SET color_scheme = $1 WHERE room_id = $2 AND client_id = $3", scheme, msg.roomId, cid)
+		res, err := tx.Exec("UPDATE player SET color_scheme = $1 WHERE room_id = $2 AND client_id = $3", scheme, msg.roomId, cid)
 		if err != nil {return err}
 
 		if affected, _ := res.RowsAffected(); affected == 0 {
-			_, err = db.Exec("INSERT INTO player (room_id, client_id, color_scheme) " +
+			_, err = tx.Exec("INSERT INTO player (room_id, client_id, color_scheme) " +
 								"VALUES ($1, $2, $3) RETURNING id", msg.roomId, cid, scheme)
 			if err != nil {return err}
 		}
 	}
 
-	/* TODO leave */
+	/* Departed players keep their row */
+	for _, cid := range msg.Leave {
+		_, err := tx.Exec("UPDATE player SET departed = now() WHERE room_id = $1 AND client_id = $2 AND departed IS NULL", msg.roomId, cid)
+		if err != nil {return err}
+	}
+
+	/* Out of the game, first time only */
+	for _, cid := range msg.Eliminated {
+		_, err := tx.Exec("UPDATE player SET eliminated = now() WHERE room_id = $1 AND client_id = $2 AND eliminated IS NULL", msg.roomId, cid)
+		if err != nil {return err}
+	}
 
 	/* Insert point(s) */
 	for cid, points := range msg.Points {
 		for _, p := range points {
-			_, err := db.Exec("INSERT INTO point (room_id, cid, x, y) VALUES ($1, $2, $3, $4)", msg.roomId, cid, p.X, p.Y)
+			_, err := tx.Exec("INSERT INTO point (room_id, cid, x, y) VALUES ($1, $2, $3, $4)", msg.roomId, cid, p.X, p.Y)
 			if err != nil {return err}
 		}
 	}
 
+	/* Passes take their place in the game record */
+	for _, m := range msg.Moves {
+		if !m.Pass {continue}
+
+		_, err := tx.Exec("INSERT INTO point (room_id, cid, x, y, pass) VALUES ($1, $2, 0, 0, true)", msg.roomId, m.CID)
+		if err != nil {return err}
+	}
+
+	/* Chat, stored id goes out with the broadcast */
+	for i := range msg.Chat {
+		c := &msg.Chat[i]
+		err := tx.QueryRow("INSERT INTO chat (room_id, cid, text, timestamp) VALUES ($1, $2, $3, $4) RETURNING id",
+							msg.roomId, c.CID, c.Text, c.Time).Scan(&c.ID)
+		if err != nil {return err}
+	}
+
+	/* Captured dots */
+	for cid, score := range msg.Score {
+		_, err := tx.Exec("UPDATE player SET score = $1 WHERE room_id = $2 AND client_id = $3", score, msg.roomId, cid)
+		if err != nil {return err}
+	}
+
+	/* Room options changed by the owner */
+	if msg.Settings != nil {
+		jsondata, _ := json.Marshal(msg.Settings)
+		_, err := tx.Exec("UPDATE room SET settings = $1 WHERE id = $2", jsondata, msg.roomId)
+		if err != nil {return err}
+	}
+
+	/* Clock state */
+	if msg.Clock != nil {
+		jsondata, _ := json.Marshal(msg.Clock)
+		_, err := tx.Exec("UPDATE room SET clock = $1 WHERE id = $2", jsondata, msg.roomId)
+		if err != nil {return err}
+	}
+
+	/* Game over */
+	if res := msg.Result; res != nil {
+		var winner interface{}
+		if res.Winner != "" {
+			winner = res.Winner
+		}
+		score, _ := json.Marshal(res.Score)
+		ranking, _ := json.Marshal(res.Ranking)
+
+		_, err := tx.Exec("UPDATE room SET status = 'finished', winner = $1, final_score = $2, ranking = $3, reason = $4, grounded = $5, finished = $6 WHERE id = $7",
+							winner, score, ranking, res.Reason, res.Grounded, res.Finished, msg.roomId)
+		if err != nil {return err}
+	}
+
 	/* Update area as single record */
 	for cid, area := range msg.Areas {
 		jsondata, _ := json.Marshal(area)
-		res, err := db.Exec("UPDATE area SET area = $1 WHERE room_id = $2 AND cid = $3", jsondata, msg.roomId, cid)
+		res, err := tx.Exec("UPDATE area SET area = $1 WHERE room_id = $2 AND cid = $3", jsondata, msg.roomId, cid)
 		if err != nil {return err}
 
 		if affected, _ := res.RowsAffected(); affected == 0 {
-			_, err = db.Exec("INSERT INTO area (room_id, cid, area) VALUES ($1, $2, $3)", msg.roomId, cid, jsondata)
+			_, err = tx.Exec("INSERT INTO area (room_id, cid, area) VALUES ($1, $2, $3)", msg.roomId, cid, jsondata)
 			if err != nil {return err}
 		}
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (db *PQProxy) LoadHistory(id uint64) (*GameMessage, error) {
@@ -126,8 +235,58 @@ func (db *PQProxy) LoadHistory(id uint64) (*GameMessage, error) {
 		roomId: id,
 	}
 
-	/* Load players */
-	rows, err := db.Query("SELECT client.id, player.color_scheme FROM client LEFT JOIN player ON client.id = player.client_id " +
+	/* Load room settings and result */
+	var (
+		settings, score, ranking, clock []byte
+		seq uint64
+		status, reason sql.NullString
+		winner, grounded sql.NullInt64
+		finished *time.Time
+	)
+
+	err := db.QueryRow("SELECT settings, status, winner, final_score, ranking, reason, grounded, finished, clock, seq FROM room WHERE id = $1", id).
+				Scan(&settings, &status, &winner, &score, &ranking, &reason, &grounded, &finished, &clock, &seq)
+	if err != nil {return nil, err}
+	msg.Seq = seq
+
+	msg.Settings = new(RoomSettings)
+	if settings != nil {
+		if err = json.Unmarshal(settings, msg.Settings); err != nil {
+			log.Println("LoadHistory: ", err)
+		}
+	}
+
+	if clock != nil {
+		msg.Clock = new(Clock)
+		if err = json.Unmarshal(clock, msg.Clock); err != nil {
+			log.Println("LoadHistory: ", err)
+			msg.Clock = nil
+		}
+	}
+
+	if status.String == "finished" {
+		msg.Result = &GameResult {
+			Reason: reason.String,
+			Grounded: uint(grounded.Int64),
+		}
+		if finished != nil {
+			msg.Result.Finished = *finished
+		}
+		if winner.Valid {
+			msg.Result.Winner = strconv.FormatInt(winner.Int64, 10)
+		}
+		if err = json.Unmarshal(score, &msg.Result.Score); err != nil {
+			log.Println("LoadHistory: ", err)
+		}
+		if ranking != nil {
+			if err = json.Unmarshal(ranking, &msg.Result.Ranking); err != nil {
+				log.Println("LoadHistory: ", err)
+			}
+		}
+	}
+
+	/* Load players in join order */
+	rows, err := db.Query("SELECT client.id, player.color_scheme, player.departed IS NOT NULL FROM client LEFT JOIN player ON client.id = player.client_id " +
 						"WHERE player.room_id = $1 ORDER BY timestamp", id)
 
 	if err != nil {return nil, err}
@@ -136,36 +295,83 @@ func (db *PQProxy) LoadHistory(id uint64) (*GameMessage, error) {
 	for rows.Next() {
 		var (
 			scheme sql.NullString
-			cid string
+			cid uint64
+			departed bool
 		)
 
-		err = rows.Scan(&cid, &scheme)
+		err = rows.Scan(&cid, &scheme, &departed)
+		if err != nil {return nil, err}
+
+		if departed {
+			msg.Leave = append(msg.Leave, cid)
+		}
+
+		msg.Players[strconv.FormatUint(cid, 10)] = scheme.String
+		msg.order = append(msg.order, cid)
+	}
+	err = rows.Err()
+	if err != nil {return nil, err}
+
+	/* Load eliminated players in elimination order */
+	rows, err = db.Query("SELECT client_id FROM player WHERE room_id = $1 AND eliminated IS NOT NULL ORDER BY eliminated", id)
+	if err != nil {return nil, err}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid uint64
+
+		err = rows.Scan(&cid)
 		if err != nil {return nil, err}
 
-		msg.Players[cid] = scheme.String
+		msg.Eliminated = append(msg.Eliminated, strconv.FormatUint(cid, 10))
 	}
 	err = rows.Err()
 	if err != nil {return nil, err}
 
-	/* Load points */
-	rows, err = db.Query("SELECT cid, x, y FROM point WHERE room_id=$1", id)
+	/* Load points in placement order */
+	rows, err = db.Query("SELECT cid, seat, x, y, pass FROM point WHERE room_id=$1 ORDER BY id", id)
 	if err != nil {return nil, err}
 	defer rows.Close()
 
+	var n uint
 	for rows.Next() {
 		var (
-			cid string
+			cid, seat sql.NullInt64
 			x, y uint
+			pass bool
 		)
 
-		err = rows.Scan(&cid, &x, &y)
+		err = rows.Scan(&cid, &seat, &x, &y, &pass)
 		if err != nil {return nil, err}
 
-		msg.Points[cid] = append(msg.Points[cid], Point{x, y})
+		move := Move{CID: uint64(cid.Int64), Point: Point{x, y}, Pass: pass}
+
+		/* starting position, seats not taken yet are kept aside */
+		if seat.Valid {
+			if seat.Int64 >= int64(len(msg.order)) {
+				msg.seats = append(msg.seats, SeatPoint{uint(seat.Int64), Point{x, y}})
+				continue
+			}
+			move.CID = msg.order[seat.Int64]
+			move.Preset = true
+		} else {
+			n++
+			move.No = n
+		}
+
+		if !pass {
+			key := strconv.FormatUint(move.CID, 10)
+			msg.Points[key] = append(msg.Points[key], move.Point)
+		}
+		msg.Moves = append(msg.Moves, move)
 	}
 	err = rows.Err()
 	if err != nil {return nil, err}
 
+	/* Recent chat */
+	msg.Chat, err = db.GetChat(id, 0, chatHistorySize)
+	if err != nil {return nil, err}
+
 	/* Load area */
 	rows, err = db.Query("SELECT cid, area FROM area WHERE room_id=$1", id)
 	if err != nil {return nil, err}
@@ -194,6 +400,59 @@ func (db *PQProxy) LoadHistory(id uint64) (*GameMessage, error) {
 	return &msg, nil
 }
 
+/* Take back the last move, starting position is kept */
+func (db *PQProxy) DeleteLastMove(roomId uint64) error {
+	_, err := db.Exec("DELETE FROM point WHERE id = (SELECT max(id) FROM point WHERE room_id = $1 AND seat IS NULL)", roomId)
+
+	if err != nil {
+		log.Println("DeleteLastMove: ", err)
+	}
+
+	return err
+}
+
+/* Last event number of the room */
+func (db *PQProxy) SetSequence(roomId, seq uint64) error {
+	_, err := db.Exec("UPDATE room SET seq = $1 WHERE id = $2", seq, roomId)
+
+	if err != nil {
+		log.Println("SetSequence: ", err)
+	}
+
+	return err
+}
+
+/* Chat messages older than given id (0 for the latest) in chronological order */
+func (db *PQProxy) GetChat(roomId, before uint64, limit uint) ([]ChatMessage, error) {
+	if before == 0 {
+		before = math.MaxInt64
+	}
+
+	rows, err := db.Query("SELECT id, cid, text, timestamp FROM chat WHERE room_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3",
+							roomId, before, limit)
+	if err != nil {return nil, err}
+	defer rows.Close()
+
+	var result []ChatMessage
+	for rows.Next() {
+		var c ChatMessage
+
+		err = rows.Scan(&c.ID, &c.CID, &c.Text, &c.Time)
+		if err != nil {return nil, err}
+
+		result = append(result, c)
+	}
+	err = rows.Err()
+	if err != nil {return nil, err}
+
+	/* oldest first */
+	for i, j := 0, len(result) - 1; i < j; i, j = i + 1, j - 1 {
+		result[i], result[j] = result[j], result[i]
+	}
+
+	return result, nil
+}
+
 /* login secret */
 func (db *PQProxy) NewUser(token string) (uint64, error) {
 	var cid uint64
@@ -229,13 +488,20 @@ func (db *PQProxy) NewPlayer(roomId uint64, cid uint64, scheme string) (uint64,
 	return pid, err
 }
 
+/* Player row of cid, ErrDeparted if the player has left */
 func (db *PQProxy) GetPlayer(roomId uint64, cid uint64) (uint64, error) {
-	var pid uint64
-	err := db.QueryRow("SELECT id FROM player WHERE room_id = $1 AND client_id = $2", roomId, cid).Scan(&pid)
+	var (
+		pid uint64
+		departed *time.Time
+	)
+	err := db.QueryRow("SELECT id, departed FROM player WHERE room_id = $1 AND client_id = $2", roomId, cid).Scan(&pid, &departed)
 
 	if err != nil && err != sql.ErrNoRows {
 		log.Println("GetPlayer: ", err)
 	}
+	if err == nil && departed != nil {
+		return pid, ErrDeparted
+	}
 
 	return pid, err
 }
@@ -360,11 +626,12 @@ func (db *PQProxy) GetPlayerProfile(cid, roomId uint64) (*UserProfile, error) {
 	var (
 		name, picture, scheme, link sql.NullString
 		pid uint64
+		score uint
 		ts time.Time
 	)
 
-	err := db.QueryRow("SELECT name, picture, link, player.id, color_scheme, timestamp FROM client LEFT JOIN player ON client.id = player.client_id " +
-						"WHERE client.id = $1 AND player.room_id = $2", cid, roomId).Scan(&name, &picture, &link, &pid, &scheme, &ts)
+	err := db.QueryRow("SELECT name, picture, link, player.id, color_scheme, score, timestamp FROM client LEFT JOIN player ON client.id = player.client_id " +
+						"WHERE client.id = $1 AND player.room_id = $2", cid, roomId).Scan(&name, &picture, &link, &pid, &scheme, &score, &ts)
 
 	if err != nil && err != sql.ErrNoRows {
 		log.Println("GetProfileRoom: ", err)
@@ -376,6 +643,7 @@ func (db *PQProxy) GetPlayerProfile(cid, roomId uint64) (*UserProfile, error) {
 		Picture: picture.String,
 		Player: pid,
 		Scheme: scheme.String,
+		Score: score,
 		Timestamp: ts,
 		Link: link.String,
 	}
@@ -386,7 +654,7 @@ func (db *PQProxy) GetPlayerProfile(cid, roomId uint64) (*UserProfile, error) {
 func (db *PQProxy) GetPlayers(roomId uint64) ([]UserProfile, error) {
 	var result []UserProfile
 
-	rows, err := db.Query("SELECT client.id, name, picture, link, player.id, color_scheme, timestamp " +
+	rows, err := db.Query("SELECT client.id, name, picture, link, player.id, color_scheme, score, timestamp " +
 						"FROM client LEFT JOIN player ON client.id = player.client_id " +
 						"WHERE player.room_id = $1 ORDER BY player.id", roomId)
 
@@ -397,10 +665,11 @@ func (db *PQProxy) GetPlayers(roomId uint64) ([]UserProfile, error) {
 		var (
 			name, picture, scheme, link sql.NullString
 			cid, pid uint64
+			score uint
 			ts time.Time
 		)
 
-		err = rows.Scan(&cid, &name, &picture, &link ,&pid, &scheme, &ts)
+		err = rows.Scan(&cid, &name, &picture, &link ,&pid, &scheme, &score, &ts)
 		if err != nil {return nil, err}
 
 		result = append(result, UserProfile {
@@ -409,6 +678,7 @@ func (db *PQProxy) GetPlayers(roomId uint64) ([]UserProfile, error) {
 			Picture: picture.String,
 			Player: pid,
 			Scheme: scheme.String,
+			Score: score,
 			Timestamp: ts,
 			Link: link.String,
 		})
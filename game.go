@@ -0,0 +1,809 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+	"errors"
+	"strconv"
+)
+
+/* Client actions */
+const (
+	ActionResign = "resign"
+	ActionStop = "stop" /* propose to finish and count the score */
+	ActionGround = "ground" /* finish, ungrounded dots go to the opponent */
+	ActionUndo = "undo" /* ask to take back own last move */
+	ActionUndoAccept = "undo-accept"
+	ActionUndoDecline = "undo-decline"
+	ActionDraw = "draw" /* offer a draw */
+	ActionDrawAccept = "draw-accept"
+	ActionDrawDecline = "draw-decline"
+	ActionPass = "pass" /* skip the turn */
+)
+
+/* Game end reasons */
+const (
+	ReasonBoardFull = "full"
+	ReasonResign = "resign"
+	ReasonScoreLimit = "score"
+	ReasonAgreement = "agreement"
+	ReasonGround = "ground"
+	ReasonDraw = "draw"
+	ReasonTime = "time"
+	ReasonBlocked = "blocked" /* no legal move left, the game is over when less than two players have one */
+	ReasonPass = "pass" /* everybody passed in a row */
+	ReasonLeave = "leave" /* player left the room */
+)
+
+var (
+	ErrNotPlayer = errors.New("not a player of this room")
+	ErrNoOpponent = errors.New("waiting for opponent")
+	ErrNotYourTurn = errors.New("not your turn")
+	ErrFinished = errors.New("game is over")
+	ErrUnknownAction = errors.New("unknown action")
+	ErrGroundPlayers = errors.New("grounding is only possible in two player game")
+	ErrNoUndo = errors.New("nothing to undo")
+	ErrNoOffer = errors.New("no pending offer")
+	ErrBoardSize = errors.New("board size is out of range")
+	ErrEmptyBase = errors.New("unknown empty base mode")
+	ErrStart = errors.New("unknown starting position")
+	ErrStartPlayers = errors.New("starting position is for two players only")
+	ErrPlayers = errors.New("number of players is out of range")
+	ErrRoomFull = errors.New("room is full")
+	ErrEliminated = errors.New("player is out of the game")
+	ErrDeparted = errors.New("player has left the room")
+	ErrTimeOver = errors.New("time is over")
+)
+
+const (
+	minBoardSize = 5
+	maxBoardSize = 100
+	minPlayers = 2
+	maxPlayers = 4
+)
+
+/* Per-room options chosen at creation */
+type RoomSettings struct {
+	Width uint `json:"width"`
+	Height uint `json:"height"`
+	Players uint `json:"players"` /* seats */
+	ScoreLimit uint `json:"score_limit,omitempty"` /* 0 for none */
+	Rules string `json:"rules"`
+	EmptyBase string `json:"empty_base,omitempty"`
+	Start string `json:"start,omitempty"`
+	Clock *TimeControl `json:"clock,omitempty"` /* nil for untimed game */
+	Spectators bool `json:"spectators,omitempty"` /* non-players may watch, owner can change */
+}
+
+/* Fill defaults and check ranges */
+func (s *RoomSettings) Normalize() error {
+	if s.Width == 0 {
+		s.Width = defaultBoardWidth
+	}
+	if s.Height == 0 {
+		s.Height = defaultBoardHeight
+	}
+
+	if s.Players == 0 {
+		s.Players = minPlayers
+	}
+
+	if s.Rules == "" {
+		s.Rules = defaultRules
+	}
+
+	if s.Width < minBoardSize || s.Width > maxBoardSize || s.Height < minBoardSize || s.Height > maxBoardSize {
+		return ErrBoardSize
+	}
+
+	if s.Players < minPlayers || s.Players > maxPlayers {
+		return ErrPlayers
+	}
+
+	switch s.EmptyBase {
+	case EmptyBaseNone, EmptyBaseForbid, EmptyBaseCapture:
+	default:
+		return ErrEmptyBase
+	}
+
+	if s.Clock != nil {
+		if err := s.Clock.Check(); err != nil {return err}
+	}
+
+	switch s.Start {
+	case StartEmpty, StartCross, StartRandom:
+	case StartDoubleCross:
+		if s.Width < 10 {return ErrBoardSize}
+	default:
+		return ErrStart
+	}
+
+	/* presets place dots for the first two seats */
+	if s.Start != StartEmpty && s.Players != 2 {return ErrStartPlayers}
+
+	_, err := LookupRules(s.Rules)
+	return err
+}
+
+type GameResult struct {
+	Winner string `json:"winner,omitempty"` /* empty for draw */
+	Score map[string]uint `json:"score"`
+	Ranking []string `json:"ranking"` /* best first, eliminated players last */
+	Reason string `json:"reason"`
+	Grounded uint `json:"grounded,omitempty"` /* ungrounded dots given to the opponent */
+	Finished time.Time `json:"finished"`
+}
+
+/* Proposal which needs consent of every other player */
+type offer struct {
+	from uint64
+	accepted map[uint64]bool
+}
+
+func (o *offer) make(cid uint64) {
+	o.from = cid
+	o.accepted = make(map[uint64]bool)
+}
+
+func (o *offer) cancel() {
+	o.from = 0
+	o.accepted = nil
+}
+
+/* Offer made by somebody else */
+func (o *offer) pending(cid uint64) bool {
+	return o.from != 0 && o.from != cid
+}
+
+/* Returns true when everybody agreed */
+func (o *offer) accept(cid uint64, players int) bool {
+	o.accepted[cid] = true
+	if len(o.accepted) < players - 1 {return false}
+
+	o.cancel()
+	return true
+}
+
+/* Offer state sent to clients */
+func (o *offer) state() *Offer {
+	if o.from == 0 {return nil}
+
+	s := Offer{From: formatCID(o.from)}
+	for cid := range o.accepted {
+		s.Accepted = append(s.Accepted, formatCID(cid))
+	}
+	sort.Strings(s.Accepted)
+	return &s
+}
+
+type Offer struct {
+	From string `json:"from"`
+	Accepted []string `json:"accepted,omitempty"`
+}
+
+/* Pending offers, empty when there are none */
+type Offers struct {
+	Stop []string `json:"stop,omitempty"` /* agreed to finish */
+	Undo *Offer `json:"undo,omitempty"`
+	Draw *Offer `json:"draw,omitempty"`
+}
+
+/* Game state rebuilt from room history, owned by GameServer goroutine */
+type Game struct {
+	board *Board
+	rules Ruleset
+	settings RoomSettings
+	order []uint64 /* players in join order */
+	turn int /* index in order */
+	last uint64 /* author of the last move */
+	moves uint /* moves and passes made, starting position excluded */
+	passes int /* consecutive passes */
+	out []uint64 /* resigned, lost on time or left, in elimination order */
+	departed map[uint64]bool /* left the room, the seat stays taken */
+	seats []SeatPoint /* starting position of seats not taken yet */
+
+	stop map[uint64]bool /* players agreed to finish */
+	undo offer /* take back the last move */
+	undoAgreed bool /* last move must be removed from history */
+	draw offer
+	clock *Clock /* nil for untimed game */
+	result *GameResult
+}
+
+func NewGame(hist *GameMessage) *Game {
+	g := Game {
+		stop: make(map[uint64]bool),
+		departed: make(map[uint64]bool),
+	}
+
+	if hist.Settings != nil {
+		g.settings = *hist.Settings
+	}
+	if err := g.settings.Normalize(); err != nil {
+		log.Printf("Room %d: %s\n", hist.roomId, err.Error())
+		g.settings = RoomSettings{}
+		g.settings.Normalize()
+	}
+	g.rules, _ = LookupRules(g.settings.Rules)
+	g.board = NewBoard(g.settings.Width, g.settings.Height, g.rules, g.settings.EmptyBase)
+
+	if g.settings.Clock != nil {
+		g.clock = NewClock(g.settings.Clock)
+		if hist.Clock != nil {
+			g.clock.Remaining = hist.Clock.Remaining
+			g.clock.Running = hist.Clock.Running
+			g.clock.Started = hist.Clock.Started
+		}
+	}
+
+	for _, cid := range hist.order {
+		g.AddPlayer(cid)
+	}
+	g.seats = hist.seats
+	for _, cid := range hist.Leave {
+		g.departed[cid] = true
+	}
+	for _, id := range hist.Eliminated {
+		cid, _ := strconv.ParseUint(id, 10, 64)
+		if g.index(cid) >= 0 && !g.isOut(cid) {
+			g.out = append(g.out, cid)
+		}
+	}
+
+	/* replay in original order to reproduce captures and turn */
+	for _, m := range hist.Moves {
+		var err error
+		if m.Preset {
+			_, err = g.board.Place(m.CID, m.Point)
+		} else if m.Pass {
+			g.pass(m.CID)
+		} else {
+			err = g.replay(m.CID, m.Point)
+		}
+
+		if err != nil {
+			log.Printf("Room %d: bad stored point (%d, %d): %s\n", hist.roomId, m.X, m.Y, err.Error())
+		}
+	}
+	g.result = hist.Result
+
+	/* the player after the last mover may be out already */
+	if len(g.order) != 0 {
+		g.advance(g.turn)
+	}
+
+	/* history may be rewound by undo, time spent meanwhile is kept */
+	if g.clock != nil && g.result == nil && g.clock.Running != "" && g.clock.Running != formatCID(g.Turn()) {
+		g.clock.Switch(g.Turn(), time.Now())
+	}
+
+	/* room filled up before the clock was started on join */
+	g.startClock(time.Now())
+
+	/* time may be over while nobody was in the room */
+	g.Flag(time.Now())
+
+	return &g
+}
+
+func (g *Game) index(cid uint64) int {
+	for i, c := range g.order {
+		if c == cid {return i}
+	}
+	return -1
+}
+
+func (g *Game) AddPlayer(cid uint64) {
+	if g.index(cid) < 0 {
+		g.order = append(g.order, cid)
+	}
+
+	if g.clock != nil {
+		g.clock.AddPlayer(cid)
+	}
+}
+
+/* Take a free seat. Returns starting position dots of the seat put on the board. */
+func (g *Game) Join(cid uint64) ([]Move, error) {
+	if g.departed[cid] {return nil, ErrDeparted}
+	if g.index(cid) >= 0 {return nil, nil}
+	if g.result != nil {return nil, ErrFinished}
+
+	/* seats of departed players stay taken, their dots and starting position are theirs */
+	if uint(len(g.order)) >= g.settings.Players {return nil, ErrRoomFull}
+
+	g.AddPlayer(cid)
+	start := g.takeSeat(cid, uint(len(g.order) - 1))
+
+	/* everybody else left before the game could start */
+	if left := g.remaining(); g.full() && len(left) == 1 {
+		g.finish(ReasonLeave, left[0])
+		return start, nil
+	}
+
+	/* first seat may be left already */
+	g.advance(g.turn)
+	g.startClock(time.Now())
+	return start, nil
+}
+
+/* First player's time goes as soon as the game can start */
+func (g *Game) startClock(now time.Time) {
+	if g.clock != nil && g.clock.Running == "" && g.result == nil && g.started() {
+		g.clock.Start(g.Turn(), now)
+	}
+}
+
+/* Every seat is taken. Games stored before waiting for all seats count as full once moved. */
+func (g *Game) full() bool {
+	return uint(len(g.order)) >= g.settings.Players || g.moves != 0
+}
+
+/* Moves are accepted once the room is full and somebody is left to play with */
+func (g *Game) started() bool {
+	return g.full() && len(g.remaining()) >= 2
+}
+
+/* Put starting position dots of the seat on the board */
+func (g *Game) takeSeat(cid uint64, seat uint) []Move {
+	start := []Move{}
+	seats := g.seats[:0]
+	for _, p := range g.seats {
+		if p.Seat != seat {
+			seats = append(seats, p)
+			continue
+		}
+
+		if _, err := g.board.Place(cid, p.Point); err != nil {
+			log.Printf("Starting point (%d, %d) of seat %d: %s\n", p.X, p.Y, seat, err.Error())
+			continue
+		}
+		start = append(start, Move{CID: cid, Point: p.Point, Preset: true})
+	}
+	g.seats = seats
+
+	return start
+}
+
+/* Leave the room, forfeiting the game in progress */
+func (g *Game) Leave(cid uint64) error {
+	if g.index(cid) < 0 {return ErrNotPlayer}
+	if g.departed[cid] {return ErrDeparted}
+	g.departed[cid] = true
+
+	if g.result != nil || g.isOut(cid) {return nil}
+
+	if !g.started() {
+		/* nobody to play with yet */
+		g.out = append(g.out, cid)
+	} else {
+		g.eliminate(cid, ReasonLeave, time.Now())
+	}
+	return nil
+}
+
+func (g *Game) Departed(cid uint64) bool {
+	return g.departed[cid]
+}
+
+/* Players out of the game in elimination order */
+func (g *Game) Eliminated() []uint64 {
+	return g.out
+}
+
+func (g *Game) isOut(cid uint64) bool {
+	for _, c := range g.out {
+		if c == cid {return true}
+	}
+	return false
+}
+
+/* Players who are not out, in join order */
+func (g *Game) remaining() []uint64 {
+	cids := []uint64{}
+	for _, cid := range g.order {
+		if !g.isOut(cid) {
+			cids = append(cids, cid)
+		}
+	}
+	return cids
+}
+
+/* Remaining players who have a legal move */
+func (g *Game) movable() []uint64 {
+	cids := []uint64{}
+	for _, cid := range g.remaining() {
+		if g.board.Playable(cid) {
+			cids = append(cids, cid)
+		}
+	}
+	return cids
+}
+
+/* Pass the turn to the first player starting from order index i who can move */
+func (g *Game) advance(i int) {
+	for n := 0; n < len(g.order); n++ {
+		idx := (i + n) % len(g.order)
+		if cid := g.order[idx]; !g.isOut(cid) && g.board.Playable(cid) {
+			g.turn = idx
+			return
+		}
+	}
+	g.turn = i % len(g.order)
+}
+
+/* Clock state, nil for untimed game */
+func (g *Game) Clock() *Clock {
+	return g.clock
+}
+
+/* Eliminate the player to move if out of time. Returns true if somebody lost on time. */
+func (g *Game) Flag(now time.Time) bool {
+	if g.clock == nil || g.result != nil || !g.clock.Expired(now) {return false}
+
+	g.clock.Stop()
+	g.eliminate(g.Turn(), ReasonTime, now)
+
+	return true
+}
+
+/* Put player out of the game. The game goes on while at least two players can move. */
+func (g *Game) eliminate(cid uint64, reason string, now time.Time) {
+	g.out = append(g.out, cid)
+
+	/* offers and agreement are counted over remaining players */
+	g.stop = make(map[uint64]bool)
+	g.undo.cancel()
+	g.draw.cancel()
+
+	if left := g.remaining(); len(left) == 1 {
+		g.finish(reason, left[0])
+		return
+	}
+
+	if len(g.movable()) < 2 {
+		g.finish(ReasonBlocked, g.best())
+		return
+	}
+
+	if g.order[g.turn] == cid {
+		g.advance(g.turn + 1)
+		if g.clock != nil {
+			g.clock.Start(g.Turn(), now)
+		}
+	}
+}
+
+/* The other player in two player game */
+func (g *Game) opponent(cid uint64) uint64 {
+	if g.order[0] == cid {return g.order[1]}
+	return g.order[0]
+}
+
+/* Player to move, 0 if game can't be started yet */
+func (g *Game) Turn() uint64 {
+	if !g.started() {return 0}
+	return g.order[g.turn]
+}
+
+/* Score per player according to the rules */
+func (g *Game) Score() map[string]uint {
+	score := make(map[string]uint)
+	for _, cid := range g.order {
+		score[formatCID(cid)] = g.rules.Score(g.board, cid)
+	}
+	return score
+}
+
+/* Dots captured by each player from each opponent, zeros are omitted */
+func (g *Game) Captures() map[string]map[string]uint {
+	captures := make(map[string]map[string]uint)
+	for _, cid := range g.order {
+		for _, victim := range g.order {
+			n := g.board.CapturedFrom(cid, victim)
+			if n == 0 {continue}
+
+			if captures[formatCID(cid)] == nil {
+				captures[formatCID(cid)] = make(map[string]uint)
+			}
+			captures[formatCID(cid)][formatCID(victim)] = n
+		}
+	}
+	return captures
+}
+
+func (g *Game) Offers() *Offers {
+	offers := Offers {
+		Undo: g.undo.state(),
+		Draw: g.draw.state(),
+	}
+	for cid := range g.stop {
+		offers.Stop = append(offers.Stop, formatCID(cid))
+	}
+	sort.Strings(offers.Stop)
+	return &offers
+}
+
+/* Take over offers pending in the game rebuilt from the same history. They are dropped if the game went on. */
+func (g *Game) KeepOffers(old *Game) {
+	if old == nil || old.moves != g.moves || len(old.out) != len(g.out) || g.result != nil {return}
+	g.stop, g.undo, g.draw = old.stop, old.undo, old.draw
+}
+
+/* Copy safe to pass to client goroutines */
+func (g *Game) Settings() *RoomSettings {
+	settings := g.settings
+	return &settings
+}
+
+func (g *Game) SetSpectators(enabled bool) {
+	g.settings.Spectators = enabled
+}
+
+/* Final result, nil while the game goes on */
+func (g *Game) Result() *GameResult {
+	return g.result
+}
+
+/* Number of moves and passes made so far */
+func (g *Game) Moves() uint {
+	return g.moves
+}
+
+/* Check that cid may move now */
+func (g *Game) onTurn(cid uint64) error {
+	if g.index(cid) < 0 {return ErrNotPlayer}
+	if g.result != nil {return ErrFinished}
+	if !g.started() {return ErrNoOpponent}
+	if g.Turn() != cid {return ErrNotYourTurn}
+
+	/* the player is put out by Flag, the change must reach the room */
+	if g.clock != nil && g.clock.Expired(time.Now()) {return ErrTimeOver}
+	return nil
+}
+
+/* Clock and offers after a move or pass */
+func (g *Game) moved(cid uint64) {
+	if g.clock != nil {
+		g.clock.Punch(cid, g.Turn(), time.Now())
+	}
+
+	/* any move cancels agreement and pending offers */
+	g.stop = make(map[uint64]bool)
+	g.undo.cancel()
+	g.draw.cancel()
+}
+
+/* Validate and make a move. Returns cids whose areas were changed. */
+func (g *Game) Move(cid uint64, p Point) ([]uint64, error) {
+	if err := g.onTurn(cid); err != nil {return nil, err}
+
+	changed, err := g.play(cid, p)
+	if err != nil {return nil, err}
+
+	g.moved(cid)
+
+	if g.board.Free() == 0 {
+		g.finish(ReasonBoardFull, g.best())
+		return changed, nil
+	}
+
+	if limit := g.settings.ScoreLimit; limit != 0 {
+		for _, c := range g.remaining() {
+			if g.rules.Score(g.board, c) >= limit {
+				g.finish(ReasonScoreLimit, c)
+				return changed, nil
+			}
+		}
+	}
+
+	g.eliminateBlocked(time.Now())
+
+	return changed, nil
+}
+
+/* Put out players left without a legal move, the game is over if less than two can move */
+func (g *Game) eliminateBlocked(now time.Time) {
+	if len(g.movable()) < 2 {
+		g.finish(ReasonBlocked, g.best())
+		return
+	}
+
+	for _, cid := range g.remaining() {
+		if !g.board.Playable(cid) {
+			g.eliminate(cid, ReasonBlocked, now)
+		}
+	}
+}
+
+/* Handle non-move client action */
+func (g *Game) Action(cid uint64, action string) error {
+	if g.index(cid) < 0 {return ErrNotPlayer}
+	if g.result != nil {return ErrFinished}
+	if g.isOut(cid) {return ErrEliminated}
+
+	players := len(g.remaining())
+
+	switch action {
+	case ActionResign:
+		if players < 2 {
+			g.finish(ReasonResign, 0)
+		} else if !g.started() {
+			return ErrNoOpponent
+		} else {
+			g.eliminate(cid, ReasonResign, time.Now())
+		}
+
+	case ActionStop:
+		if !g.started() {return ErrNoOpponent}
+
+		g.stop[cid] = true
+		if len(g.stop) == players {
+			g.finish(ReasonAgreement, g.best())
+		}
+
+	case ActionGround:
+		if len(g.order) != 2 {return ErrGroundPlayers}
+		if g.Turn() != cid {return ErrNotYourTurn}
+
+		g.ground(cid)
+
+	case ActionUndo:
+		if g.last != cid {return ErrNoUndo}
+		g.undo.make(cid)
+
+	case ActionUndoAccept:
+		if !g.undo.pending(cid) {return ErrNoUndo}
+		g.undoAgreed = g.undo.accept(cid, players)
+
+	case ActionUndoDecline:
+		if !g.undo.pending(cid) {return ErrNoUndo}
+		g.undo.cancel()
+
+	case ActionDraw:
+		if !g.started() {return ErrNoOpponent}
+		g.draw.make(cid)
+
+	case ActionDrawAccept:
+		if !g.draw.pending(cid) {return ErrNoOffer}
+		if g.draw.accept(cid, players) {
+			g.finish(ReasonDraw, 0)
+		}
+
+	case ActionDrawDecline:
+		if !g.draw.pending(cid) {return ErrNoOffer}
+		g.draw.cancel()
+
+	case ActionPass:
+		if err := g.onTurn(cid); err != nil {return err}
+
+		g.pass(cid)
+		g.moved(cid)
+
+		if g.passes >= players {
+			g.finish(ReasonPass, g.best())
+		}
+
+	default:
+		return ErrUnknownAction
+	}
+
+	return nil
+}
+
+/* Finish the game counting cid's dots not connected to the edge as captured by the opponent.
+Score is taken from the rules, so grounded dots count in the same unit as anything else. */
+func (g *Game) ground(cid uint64) {
+	opponent := g.opponent(cid)
+
+	ungrounded := g.board.Ungrounded(cid)
+	grounded := g.board.Grounded(cid, opponent)
+
+	score := make(map[string]uint)
+	for _, c := range g.order {
+		score[formatCID(c)] = g.rules.Score(grounded, c)
+	}
+
+	var winner uint64
+	if a, b := score[formatCID(cid)], score[formatCID(opponent)]; a > b {
+		winner = cid
+	} else if b > a {
+		winner = opponent
+	}
+
+	g.finish(ReasonGround, winner)
+	g.result.Score = score
+	g.result.Ranking = g.ranking(score)
+	g.result.Grounded = ungrounded
+}
+
+/* Remaining players ordered by score */
+type byScore struct {
+	cids []uint64
+	score map[string]uint
+}
+
+func (s byScore) Len() int {return len(s.cids)}
+func (s byScore) Less(i, j int) bool {return s.score[formatCID(s.cids[i])] > s.score[formatCID(s.cids[j])]}
+func (s byScore) Swap(i, j int) {s.cids[i], s.cids[j] = s.cids[j], s.cids[i]}
+
+/* Remaining players by score (ties in join order), then eliminated ones, the last eliminated first */
+func (g *Game) ranking(score map[string]uint) []string {
+	cids := g.remaining()
+	sort.Stable(byScore{cids, score})
+
+	for i := len(g.out) - 1; i >= 0; i-- {
+		cids = append(cids, g.out[i])
+	}
+
+	ranking := make([]string, len(cids))
+	for i, cid := range cids {
+		ranking[i] = formatCID(cid)
+	}
+	return ranking
+}
+
+/* Remaining player with the best score, 0 on tie */
+func (g *Game) best() uint64 {
+	cids := g.remaining()
+	if len(cids) == 0 {return 0}
+
+	score := g.Score()
+	sort.Stable(byScore{cids, score})
+
+	if len(cids) > 1 && score[formatCID(cids[0])] == score[formatCID(cids[1])] {return 0}
+	return cids[0]
+}
+
+func (g *Game) finish(reason string, winner uint64) {
+	if g.clock != nil {
+		g.clock.Stop()
+	}
+
+	score := g.Score()
+	g.result = &GameResult {
+		Winner: formatCID(winner),
+		Score: score,
+		Ranking: g.ranking(score),
+		Reason: reason,
+		Finished: time.Now(),
+	}
+}
+
+func (g *Game) play(cid uint64, p Point) ([]uint64, error) {
+	changed, err := g.board.Place(cid, p)
+	if err != nil {return nil, err}
+
+	g.played(cid)
+	return changed, nil
+}
+
+/* Stored move. Dots inside areas were accepted before, such records are replayed as they were played. */
+func (g *Game) replay(cid uint64, p Point) error {
+	if _, err := g.board.Replay(cid, p); err != nil {return err}
+
+	g.played(cid)
+	return nil
+}
+
+func (g *Game) played(cid uint64) {
+	g.last = cid
+	g.moves++
+	g.passes = 0
+
+	/* next after the mover who can still play */
+	if i := g.index(cid); i >= 0 {
+		g.advance(i + 1)
+	}
+}
+
+func (g *Game) pass(cid uint64) {
+	g.last = cid
+	g.moves++
+	g.passes++
+
+	if i := g.index(cid); i >= 0 {
+		g.advance(i + 1)
+	}
+}
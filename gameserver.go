@@ -2,6 +2,9 @@ package main
 
 import (
 	"log"
+	"errors"
+	"time"
+	"strconv"
 	"container/list"
 )
 
@@ -10,6 +13,15 @@ type Point struct {
 	Y uint `json:"y"`
 }
 
+/* Single dot or pass in placement order */
+type Move struct {
+	No uint `json:"no,omitempty"` /* position in the game record, 0 for starting position */
+	CID uint64 `json:"cid"`
+	Point
+	Pass bool `json:"pass,omitempty"`
+	Preset bool `json:"preset,omitempty"` /* starting position, doesn't pass the turn */
+}
+
 type GameMessage struct {
 	roomId uint64 `json:"-"`
 	sender *Client `json:"-"`
@@ -21,16 +33,44 @@ type GameMessage struct {
 	Areas map[string][][]Point `json:"a,omitempty"`
 
 	Players map[string]string `json:"players,omitempty"`
-	Leave []uint64 `json:"leave,omitempty"`
-
+	Presence map[string]bool `json:"presence,omitempty"` /* cid is online */
+	Spectators map[string]bool `json:"spectators,omitempty"` /* cid is watching */
+	Leave []uint64 `json:"leave,omitempty"` /* departed players */
+
+	Score map[string]uint `json:"score,omitempty"`
+	Captures map[string]map[string]uint `json:"captures,omitempty"` /* per opponent */
+	Eliminated []string `json:"eliminated,omitempty"`
+	Turn string `json:"turn,omitempty"`
+	Action string `json:"action,omitempty"`
+	Result *GameResult `json:"result,omitempty"`
+	Settings *RoomSettings `json:"settings,omitempty"`
+	Clock *Clock `json:"clock,omitempty"`
+	Offers *Offers `json:"offers,omitempty"`
+	Error string `json:"error,omitempty"`
+	Code string `json:"code,omitempty"` /* error class */
+	Ref string `json:"ref,omitempty"` /* id of the client message the error refers to */
+	ID string `json:"id,omitempty"` /* client message id */
+	Seq uint64 `json:"seq,omitempty"` /* room event number */
+	Moves []Move `json:"moves,omitempty"` /* game record */
+	Chat []ChatMessage `json:"chat,omitempty"`
+
+	kind string `json:"-"` /* envelope type if not implied by contents */
+	order []uint64 `json:"-"`
+	seats []SeatPoint `json:"-"` /* starting position of seats not taken yet */
+	start []Move `json:"-"` /* starting position of the seat taken by the message */
+
+	spectate *bool `json:"-"` /* owner toggles spectating */
 	sync chan<- bool `json:"-"`
 }
 
 type Client struct {
 	cid uint64
 	roomId uint64
+	since uint64 /* last event seen before reconnect, 0 for none */
+	spectator bool /* read-only */
 	server *GameServer
 	msg chan *GameMessage
+	dropped bool /* msg is closed, removed from the room on the next sweep */
 }
 
 type GameServer struct {
@@ -39,12 +79,22 @@ type GameServer struct {
 	msg chan *GameMessage
 	roomId uint64
 	pool *GamePool
+	game *Game
+	flag *time.Timer /* fires when the player to move runs out of time */
+	who chan chan<- *Presence /* presence queries */
+	online map[uint64]int /* live player clients per cid */
+	watching map[uint64]int /* live spectator clients per cid */
+	seq uint64 /* last event number */
+	reserved uint64 /* event numbers up to it are stored already */
+	backlog [backlogSize]*GameMessage /* recent events by seq modulo size */
+	limits map[uint64]*rateLimiter /* per cid, websocket and HTTP messages alike */
 
 	ref uint
 }
 
 type gamePoolMsg struct {
 	roomId uint64
+	lookup bool /* don't start the server if it isn't running */
 	reply chan<- *GameServer
 }
 
@@ -54,61 +104,612 @@ type GamePool struct {
 	put chan uint64
 }
 
-/* TODO: report online/offline users */
+/* Online players and spectators */
+type Presence struct {
+	Players map[string]bool
+	Spectators map[string]bool
+}
+
+var (
+	ErrBadMove = errors.New("exactly one own point per move expected")
+	ErrSpectator = errors.New("spectators can't play")
+	ErrNotOwner = errors.New("only room owner can do this")
+	ErrNoSpectators = errors.New("room is not open for spectators")
+	ErrStorage = errors.New("move can't be saved, try again")
+	ErrMixedMessage = errors.New("one change per message expected")
+)
+
+const (
+	backlogSize = 32 /* events kept for resuming clients */
+	clientQueue = backlogSize * 2 /* resumed events and some new ones */
+	seqBlock = 64 /* event numbers stored at once */
+)
+
+/* Rebuild game from stored history */
+func (srv *GameServer) loadGame() {
+	hist, err := db.LoadHistory(srv.roomId)
+	if err != nil {
+		log.Printf("db.LoadHistory: %s\n", err.Error())
+		hist = &GameMessage{roomId: srv.roomId}
+	}
+
+	old := srv.game
+	srv.game = NewGame(hist)
+	srv.game.KeepOffers(old)
+
+	/* restarted room goes on after the numbers reserved by the previous run */
+	if hist.Seq > srv.reserved {
+		srv.seq, srv.reserved = hist.Seq, hist.Seq
+	}
+
+	/* flag fell while the room was empty */
+	if len(srv.game.Eliminated()) != len(hist.Eliminated) || (hist.Result == nil && srv.game.Result() != nil) {
+		srv.saveState()
+	}
+}
+
+/* Persist clock, eliminations and result */
+func (srv *GameServer) saveState() *GameMessage {
+	msg := GameMessage {
+		roomId: srv.roomId,
+		Turn: formatCID(srv.game.Turn()),
+		Result: srv.game.Result(),
+	}
+	for _, cid := range srv.game.Eliminated() {
+		msg.Eliminated = append(msg.Eliminated, formatCID(cid))
+	}
+	if clock := srv.game.Clock(); clock != nil {
+		msg.Clock = clock.Snapshot()
+	}
+
+	if err := db.PostHistory(&msg); err != nil {
+		log.Printf("db.PostHistory: %s\n", err.Error())
+	}
+	return &msg
+}
+
+/* Eliminate the player who ran out of time and tell everybody */
+func (srv *GameServer) flagFall(clients *list.List) {
+	if !srv.game.Flag(time.Now()) {return}
+
+	msg := srv.saveState()
+	srv.record(msg)
+	for e := clients.Front(); e != nil; e = e.Next() {
+		srv.deliver(e.Value.(*Client), msg)
+	}
+}
+
+/* Number the event and keep it for resuming clients */
+func (srv *GameServer) record(msg *GameMessage) {
+	srv.seq++
+	msg.Seq = srv.seq
+	srv.backlog[srv.seq % backlogSize] = msg
+
+	/* a block of numbers is stored ahead so it isn't written on every event */
+	if srv.seq > srv.reserved {
+		if err := db.SetSequence(srv.roomId, srv.seq + seqBlock); err != nil {
+			log.Printf("db.SetSequence: %s\n", err.Error())
+			return
+		}
+		srv.reserved = srv.seq + seqBlock
+	}
+}
+
+/* Count client message against the sender's rate limit */
+func (srv *GameServer) allow(cid uint64) bool {
+	limit := srv.limits[cid]
+	if limit == nil {
+		limit = new(rateLimiter)
+		srv.limits[cid] = limit
+	}
+	return limit.allow(time.Now())
+}
+
+/* Queue event for the client. The one which doesn't keep up is dropped instead of stalling the room,
+it resumes from the last event it got after reconnect. */
+func (srv *GameServer) deliver(cl *Client, msg *GameMessage) {
+	if cl.dropped {return}
+
+	select {
+	case cl.msg <- msg:
+	default:
+		log.Printf("Room %d: client of %d falls behind, dropped\n", srv.roomId, cl.cid)
+		cl.drop()
+	}
+}
+
+func (cl *Client) drop() {
+	if cl.dropped {return}
+
+	cl.dropped = true
+	close(cl.msg)
+}
+
+/* Remove dropped clients, their departure may drop more */
+func (srv *GameServer) sweep(clients *list.List) {
+	for e := clients.Front(); e != nil; {
+		cl := e.Value.(*Client)
+		if !cl.dropped {
+			e = e.Next()
+			continue
+		}
+
+		clients.Remove(e)
+		srv.setOnline(cl, -1, clients)
+		e = clients.Front()
+	}
+}
+
+/* Connected cids */
+func presence(counts map[uint64]int) map[string]bool {
+	presence := make(map[string]bool)
+	for cid := range counts {
+		presence[formatCID(cid)] = true
+	}
+	return presence
+}
+
+/* Count client connection, tell everybody when cid goes online or offline */
+func (srv *GameServer) setOnline(cl *Client, delta int, clients *list.List) {
+	counts := srv.online
+	if cl.spectator {
+		counts = srv.watching
+	}
+
+	was := counts[cl.cid] != 0
+	counts[cl.cid] += delta
+	if counts[cl.cid] <= 0 {
+		delete(counts, cl.cid)
+	}
+
+	now := counts[cl.cid] != 0
+	if was == now {return}
+
+	change := map[string]bool {
+		formatCID(cl.cid): now,
+	}
+	msg := GameMessage{}
+	if cl.spectator {
+		msg.Spectators = change
+	} else {
+		msg.Presence = change
+	}
+	srv.record(&msg)
+
+	for e := clients.Front(); e != nil; e = e.Next() {
+		srv.deliver(e.Value.(*Client), &msg)
+	}
+}
+
+/* Send events missed by reconnecting client, whole history if some are gone */
+func (srv *GameServer) resume(cl *Client) {
+	if cl.since != 0 && cl.since <= srv.seq && srv.seq - cl.since <= backlogSize {
+		missed := []*GameMessage{}
+		for seq := cl.since + 1; seq <= srv.seq; seq++ {
+			msg := srv.backlog[seq % backlogSize]
+			if msg == nil || msg.Seq != seq {
+				missed = nil
+				break
+			}
+			missed = append(missed, msg)
+		}
+
+		if missed != nil {
+			for _, msg := range missed {
+				srv.deliver(cl, msg)
+			}
+			return
+		}
+	}
+
+	if hist := srv.history(); hist != nil {
+		/* resuming client drops what it has, it may be undone meanwhile */
+		if cl.since != 0 {
+			hist.Flags |= FlagReset
+		}
+		srv.deliver(cl, hist)
+	}
+}
+
+/* Rearm flag fall timer */
+func (srv *GameServer) armClock() <-chan time.Time {
+	if srv.flag != nil {
+		srv.flag.Stop()
+		srv.flag = nil
+	}
+
+	clock := srv.game.Clock()
+	if clock == nil || srv.game.Result() != nil {return nil}
+
+	deadline := clock.Deadline()
+	if deadline.IsZero() {return nil}
+
+	srv.flag = time.NewTimer(deadline.Sub(time.Now()))
+	return srv.flag.C
+}
+
+/* Full room state for a newcomer */
+func (srv *GameServer) history() *GameMessage {
+	hist, err := db.LoadHistory(srv.roomId)
+	if err != nil {
+		log.Printf("db.LoadHistory: %s\n", err.Error())
+		return nil
+	}
+
+	hist.kind = KindHistory
+	hist.Seq = srv.seq
+	hist.Presence = presence(srv.online)
+	hist.Spectators = presence(srv.watching)
+	hist.Settings = srv.game.Settings()
+	hist.Areas = srv.game.board.AllAreas()
+	hist.Score = srv.game.Score()
+	hist.Captures = srv.game.Captures()
+	hist.Turn = formatCID(srv.game.Turn())
+	hist.Result = srv.game.Result()
+	hist.Offers = srv.game.Offers()
+	hist.Clock = nil
+	if clock := srv.game.Clock(); clock != nil {
+		hist.Clock = clock.Snapshot()
+	}
+
+	return hist
+}
+
+/* Validate client move and put it on the board. Client-sent areas are replaced with computed ones. */
+func (srv *GameServer) placePoints(msg *GameMessage) error {
+	msg.Areas = nil
+	if len(msg.Points) == 0 {return nil}
+
+	points, ok := msg.Points[strconv.FormatUint(msg.CID, 10)]
+	if len(msg.Points) != 1 || !ok || len(points) != 1 {return ErrBadMove}
+
+	changed, err := srv.game.Move(msg.CID, points[0])
+	if err != nil {return err}
+
+	msg.Moves = []Move{{No: srv.game.Moves(), CID: msg.CID, Point: points[0]}}
+
+	if len(changed) != 0 {
+		msg.Areas = make(map[string][][]Point)
+		for _, cid := range changed {
+			msg.Areas[strconv.FormatUint(cid, 10)] = srv.game.board.Areas(cid)
+		}
+		msg.Score = srv.game.Score()
+		msg.Captures = srv.game.Captures()
+	}
+
+	return nil
+}
+
+/* Starting position dots of the seat taken by msg */
+func (srv *GameServer) seatMessage(msg *GameMessage) *GameMessage {
+	start := GameMessage {
+		kind: KindState,
+		CID: msg.CID,
+		Points: make(map[string][]Point),
+		Moves: msg.start,
+		Turn: formatCID(srv.game.Turn()),
+	}
+	for _, m := range msg.start {
+		id := formatCID(m.CID)
+		start.Points[id] = append(start.Points[id], m.Point)
+	}
+	return &start
+}
+
+/* Turn spectating on or off, the owner only */
+func (srv *GameServer) setSpectators(msg *GameMessage) error {
+	if len(srv.game.order) == 0 || srv.game.order[0] != msg.CID {return ErrNotOwner}
+
+	srv.game.SetSpectators(*msg.spectate)
+	msg.Settings = srv.game.Settings()
+
+	return nil
+}
+
+/* Disconnect clients of the player who left, they are let in no more */
+func (srv *GameServer) dropPlayer(cid uint64, clients *list.List) {
+	for e := clients.Front(); e != nil; e = e.Next() {
+		if cl := e.Value.(*Client); cl.cid == cid && !cl.spectator {
+			cl.drop()
+		}
+	}
+}
+
+/* Disconnect spectators after spectating is turned off */
+func (srv *GameServer) dropSpectators(clients *list.List) {
+	for e := clients.Front(); e != nil; {
+		cl := e.Value.(*Client)
+		next := e.Next()
+
+		if cl.spectator {
+			clients.Remove(e)
+			srv.setOnline(cl, -1, clients)
+			cl.drop()
+		}
+		e = next
+	}
+}
+
+/* Number of game changes requested by the message, client-sent areas don't count */
+func (msg *GameMessage) changes() int {
+	n := 0
+	for _, present := range []bool{len(msg.Points) != 0, msg.Action != "", len(msg.Players) != 0, len(msg.Leave) != 0, len(msg.Chat) != 0, msg.spectate != nil} {
+		if present {n++}
+	}
+	return n
+}
+
+/* Apply client message to the game state. Each change is fully checked before the game is touched,
+so a message carrying one change is either applied or rejected as a whole. */
+func (srv *GameServer) apply(msg *GameMessage) error {
+	if msg.changes() > 1 {return ErrMixedMessage}
+
+	msg.Result = nil
+	msg.Score = nil /* stored and sent only as computed by the game */
+	msg.Flags = 0 /* reset is sent by undo only */
+	msg.Presence, msg.Spectators = nil, nil /* come from connected clients only */
+	msg.Captures = nil
+	msg.Eliminated = nil
+	msg.Moves = nil
+	msg.Error, msg.Code, msg.Ref = "", "", ""
+	msg.Settings = nil
+	msg.Offers = nil
+	finished := srv.game.Result() != nil
+	out := len(srv.game.Eliminated())
+
+	if msg.sender != nil && msg.sender.spectator {return ErrSpectator}
+	if srv.game.Departed(msg.CID) {return ErrDeparted}
+
+	if msg.spectate != nil {
+		if err := srv.setSpectators(msg); err != nil {return err}
+	}
+
+	if len(msg.Chat) != 0 {
+		if len(msg.Chat) != 1 {return ErrBadChat}
+		if err := msg.Chat[0].Prepare(msg.CID, time.Now()); err != nil {return err}
+	}
+
+	if err := srv.placePoints(msg); err != nil {return err}
+
+	if msg.Action != "" {
+		if err := srv.game.Action(msg.CID, msg.Action); err != nil {return err}
+
+		if msg.Action == ActionPass {
+			msg.Moves = []Move{{No: srv.game.Moves(), CID: msg.CID, Pass: true}}
+		}
+	}
+
+	/* one can only take a seat for oneself, the entry sets the sender's scheme whatever cid it names */
+	if len(msg.Players) != 0 {
+		if len(msg.Players) != 1 {return ErrMixedMessage}
+
+		var scheme string
+		for _, scheme = range msg.Players {}
+
+		start, err := srv.game.Join(msg.CID)
+		if err != nil {return err}
+		msg.start = start
+		msg.Players = map[string]string{formatCID(msg.CID): scheme}
+	}
+
+	/* only oneself can leave */
+	if len(msg.Leave) != 0 {
+		if err := srv.game.Leave(msg.CID); err != nil {return err}
+		msg.Leave = []uint64{msg.CID}
+	}
+	msg.Turn = formatCID(srv.game.Turn())
+
+	for _, cid := range srv.game.Eliminated()[out:] {
+		msg.Eliminated = append(msg.Eliminated, formatCID(cid))
+	}
+
+	if !finished {
+		msg.Result = srv.game.Result()
+	}
+
+	msg.Clock = nil
+	if clock := srv.game.Clock(); clock != nil && (len(msg.Moves) != 0 || len(msg.Players) != 0 || len(msg.Leave) != 0 || len(msg.Eliminated) != 0 || msg.Result != nil) {
+		msg.Clock = clock.Snapshot()
+	}
+
+	/* offers are made by actions and cancelled by moves and eliminations */
+	if msg.Action != "" || len(msg.Moves) != 0 || len(msg.Eliminated) != 0 {
+		msg.Offers = srv.game.Offers()
+	}
+
+	return nil
+}
+
+/* Remove the last move and send corrected state to everybody */
+func (srv *GameServer) undo(clients *list.List) {
+	if err := db.DeleteLastMove(srv.roomId); err != nil {
+		srv.game.undoAgreed = false
+		return
+	}
+	srv.loadGame()
+
+	/* store recomputed areas and score */
+	state := GameMessage {
+		roomId: srv.roomId,
+		Areas: make(map[string][][]Point),
+		Score: srv.game.Score(),
+	}
+	for _, cid := range srv.game.order {
+		state.Areas[formatCID(cid)] = srv.game.board.Areas(cid)
+	}
+	if clock := srv.game.Clock(); clock != nil {
+		state.Clock = clock.Snapshot()
+	}
+
+	if err := db.PostHistory(&state); err != nil {
+		log.Printf("db.PostHistory: %s\n", err.Error())
+	}
+
+	if hist := srv.history(); hist != nil {
+		hist.Flags |= FlagReset
+		srv.record(hist)
+		for e := clients.Front(); e != nil; e = e.Next() {
+			srv.deliver(e.Value.(*Client), hist)
+		}
+	}
+}
+
+/* Report refused message back to its sender */
+func (srv *GameServer) reject(msg *GameMessage, err error) {
+	log.Printf("Room %d: rejected message from %d: %s\n", srv.roomId, msg.CID, err.Error())
+
+	if msg.sender != nil {
+		reply := errorMessage(err, msg.ID)
+		reply.CID = msg.CID
+		srv.deliver(msg.sender, reply)
+	}
+
+	if msg.sync != nil {
+		msg.sync <- false
+	}
+}
 
 func (srv *GameServer) gameServer() {
 	clients := list.New()
+	srv.loadGame()
+	flag := srv.armClock()
 
 	/* main loop */
 	for {
 		select {
-		case cl, ok := <-srv.add:
-			if !ok {return}
-			clients.PushBack(cl)
+		case <-flag:
+			srv.flagFall(clients)
+			flag = srv.armClock()
 
-			/* load history */
-			hist, err := db.LoadHistory(srv.roomId)
-			if err != nil {
-				log.Printf("db.LoadHistory: %s\n", err.Error())
-			} else if len(hist.Points) != 0 || len(hist.Areas) != 0 || len(hist.Players) != 0 {
-				cl.msg <- hist
+		case cl, ok := <-srv.add:
+			if !ok {
+				if srv.flag != nil {
+					srv.flag.Stop()
+				}
+				return
 			}
+			/* spectating may be turned off meanwhile */
+			if cl.spectator && !srv.game.Settings().Spectators {
+				srv.deliver(cl, errorMessage(ErrNoSpectators, ""))
+				cl.drop()
+				break
+			}
+
+			clients.PushBack(cl)
+			srv.resume(cl)
+			srv.setOnline(cl, 1, clients)
 
 		case cl := <-srv.remove:
 			for e := clients.Front(); e != nil; e = e.Next() {
 				if e.Value.(*Client) == cl {
 					clients.Remove(e)
+					srv.setOnline(cl, -1, clients)
 					break
 				}
 			}
 
+		case reply := <-srv.who:
+			reply <- &Presence{presence(srv.online), presence(srv.watching)}
+
 		case msg := <-srv.msg:
-			/* post history */
+			if !srv.allow(msg.CID) {
+				srv.reject(msg, ErrRateLimit)
+				break
+			}
+
+			/* time may be over before the timer fired */
+			srv.flagFall(clients)
+
+			if err := srv.apply(msg); err != nil {
+				srv.reject(msg, err)
+
+				/* flag fell after the check above */
+				if err == ErrTimeOver {
+					srv.flagFall(clients)
+					flag = srv.armClock()
+				}
+				break
+			}
+
+			/* post history, memory is rolled back to the stored state if it fails */
 			if err := db.PostHistory(msg); err != nil {
 				log.Printf("db.PostHistory: %s\n", err.Error())
+				srv.loadGame()
+				srv.reject(msg, ErrStorage)
+				break
 			}
-			/* TODO leave */
+
+			srv.record(msg)
 
 			if msg.sync != nil {
 				msg.sync <- true
 			}
 
+			/* sender already has its point but not the computed state */
+			var areas *GameMessage
+			if len(msg.Moves) != 0 || len(msg.Eliminated) != 0 || len(msg.Leave) != 0 || len(msg.Chat) != 0 || msg.Result != nil {
+				areas = &GameMessage {
+					CID: msg.CID,
+					Moves: msg.Moves,
+					Areas: msg.Areas,
+					Score: msg.Score,
+					Captures: msg.Captures,
+					Eliminated: msg.Eliminated,
+					Leave: msg.Leave,
+					Chat: msg.Chat,
+					Turn: msg.Turn,
+					Result: msg.Result,
+					Clock: msg.Clock,
+					Seq: msg.Seq,
+				}
+			}
+
 			for e := clients.Front(); e != nil; e = e.Next() {
 				client := e.Value.(*Client)
 
 				if msg.sender != client {
-					client.msg <- msg
+					srv.deliver(client, msg)
+				} else if areas != nil {
+					srv.deliver(client, areas)
 				}
 			}
+
+			if msg.spectate != nil && !*msg.spectate {
+				srv.dropSpectators(clients)
+			}
+
+			if len(msg.Leave) != 0 {
+				srv.dropPlayer(msg.CID, clients)
+			}
+
+			if srv.game.undoAgreed {
+				srv.undo(clients)
+			}
+
+			/* starting position of the new seat appears on the board, it is stored already */
+			if len(msg.start) != 0 {
+				start := srv.seatMessage(msg)
+				srv.record(start)
+				for e := clients.Front(); e != nil; e = e.Next() {
+					srv.deliver(e.Value.(*Client), start)
+				}
+			}
+
+			flag = srv.armClock()
 		}
+
+		srv.sweep(clients)
 	}
 }
 
-func (srv *GameServer) NewClient(cid uint64) *Client {
+/* Connect client, since is the last event it has seen or 0 */
+func (srv *GameServer) NewClient(cid, since uint64, spectator bool) *Client {
 	client := Client {
 		cid: cid,
 		roomId: srv.roomId,
-		msg: make(chan *GameMessage, 32),
+		since: since,
+		spectator: spectator,
+		msg: make(chan *GameMessage, clientQueue),
 		server: srv,
 	}
 	srv.add <- &client
@@ -116,10 +717,28 @@ func (srv *GameServer) NewClient(cid uint64) *Client {
 	return &client
 }
 
+/* Client posting a single message over HTTP. It isn't subscribed to room events and gets only the rejection. */
+func (srv *GameServer) NewSender(cid uint64, spectator bool) *Client {
+	return &Client {
+		cid: cid,
+		roomId: srv.roomId,
+		spectator: spectator,
+		msg: make(chan *GameMessage, 1),
+		server: srv,
+	}
+}
+
 func (srv *GameServer) Post(msg *GameMessage) {
 	srv.msg <- msg
 }
 
+/* Online players and spectators of the room */
+func (srv *GameServer) Online() *Presence {
+	reply := make(chan *Presence)
+	srv.who <- reply
+	return <-reply
+}
+
 func (srv *GameServer) Get() *GameServer {
 	srv.pool.get <- srv.roomId
 	return srv
@@ -139,6 +758,10 @@ func newGameServer(pool *GamePool, roomId uint64) *GameServer {
 		add: make(chan *Client),
 		remove: make(chan *Client),
 		msg: make(chan *GameMessage, 32),
+		who: make(chan chan<- *Presence),
+		online: make(map[uint64]int),
+		watching: make(map[uint64]int),
+		limits: make(map[uint64]*rateLimiter),
 		roomId: roomId,
 		pool: pool,
 		ref: 1,
@@ -155,7 +778,14 @@ func (client *Client) Cancel() {
 
 func (srv *GamePool) Get(roomId uint64) *GameServer {
 	reply := make(chan *GameServer)
-	srv.req <- &gamePoolMsg{roomId, reply}
+	srv.req <- &gamePoolMsg{roomId, false, reply}
+	return <-reply
+}
+
+/* Running server of the room or nil, doesn't start a new one */
+func (srv *GamePool) Lookup(roomId uint64) *GameServer {
+	reply := make(chan *GameServer)
+	srv.req <- &gamePoolMsg{roomId, true, reply}
 	return <-reply
 }
 
@@ -178,6 +808,8 @@ func (pool *GamePool) gamePool() {
 			srv, ok := servers[req.roomId]
 			if ok {
 				srv.ref++
+			} else if req.lookup {
+				srv = nil
 			} else {
 				srv = newGameServer(pool, req.roomId)
 				servers[req.roomId] = srv
@@ -8,6 +8,8 @@ import (
 	"time"
 	"html/template"
 	"strconv"
+	"strings"
+	"encoding/json"
 
 	"code.google.com/p/go.net/websocket"
 	"github.com/gorilla/mux"
@@ -24,6 +26,7 @@ const (
 	keepAliveInterval = 30 /* sec */
 
 	FlagKeepAlive = 0x1
+	FlagReset = 0x2 /* drop local state, message carries the whole game */
 
 	GraphAPIProfile = "https://graph.facebook.com/v2.1/me"
 	GraphAPIPicture = "https://graph.facebook.com/v2.1/me/picture?type=large&redirect=false"
@@ -59,6 +62,11 @@ type invitationReply struct {
 	Code string `json:"code"`
 }
 
+type leaveReply struct {
+	Room uint64 `json:"room"`
+	Status string `json:"status"`
+}
+
 /*-------------------------------------------------------------------------------*/
 
 func NewRoom(w http.ResponseWriter, req *http.Request) {
@@ -103,7 +111,11 @@ func NewRoom(w http.ResponseWriter, req *http.Request) {
 				}
 
 				room.Post(&msg)
-				<-sync
+				if !<-sync {
+					/* room is full or the game is over */
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
 
 				http.Redirect(w, req, "/" + uid + "/", http.StatusTemporaryRedirect)
 				return
@@ -112,9 +124,15 @@ func NewRoom(w http.ResponseWriter, req *http.Request) {
 	}
 
 	/* new room */
+	settings, err := roomSettings(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	newUid := randStr(6)
 
-	roomId, err := db.NewRoom(newUid)
+	roomId, err := db.NewRoom(newUid, settings)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -133,6 +151,57 @@ func NewRoom(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, "/" + newUid + "/", http.StatusTemporaryRedirect)
 }
 
+/* Parse numeric form values into given fields */
+func formUints(req *http.Request, fields map[string]*uint) error {
+	for name, val := range fields {
+		if str := req.FormValue(name); str != "" {
+			n, err := strconv.ParseUint(str, 10, 32)
+			if err != nil {return err}
+			*val = uint(n)
+		}
+	}
+	return nil
+}
+
+/* Room options from form values or JSON body */
+func roomSettings(req *http.Request) (*RoomSettings, error) {
+	settings := new(RoomSettings)
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(req.Body).Decode(settings); err != nil {return nil, err}
+
+	} else {
+		err := formUints(req, map[string]*uint {
+			"width": &settings.Width,
+			"height": &settings.Height,
+			"players": &settings.Players,
+			"score_limit": &settings.ScoreLimit,
+		})
+		if err != nil {return nil, err}
+
+		settings.Rules = req.FormValue("rules")
+		settings.EmptyBase = req.FormValue("empty_base")
+		settings.Start = req.FormValue("start")
+		settings.Spectators, _ = strconv.ParseBool(req.FormValue("spectators"))
+
+		/* time control */
+		if mode := req.FormValue("clock"); mode != "" {
+			settings.Clock = &TimeControl{Mode: mode}
+
+			err = formUints(req, map[string]*uint {
+				"clock_base": &settings.Clock.Base,
+				"clock_increment": &settings.Clock.Increment,
+				"clock_per_move": &settings.Clock.PerMove,
+			})
+			if err != nil {return nil, err}
+		}
+	}
+
+	if err := settings.Normalize(); err != nil {return nil, err}
+
+	return settings, nil
+}
+
 func Login(w http.ResponseWriter, req *http.Request) {
 	session, _ := store.Get(req, "session")
 
@@ -276,6 +345,8 @@ type UserProfile struct {
 	Picture string `json:"picture,omitempty"`
 	Player uint64 `json:"player,omitempty"`
 	Scheme string `json:"scheme,omitempty"`
+	Score uint `json:"score"`
+	Online bool `json:"online"`
 	Timestamp time.Time `json:"timestamp,omitempty"`
 	Link string `json:"link,omitempty"`
 }
@@ -303,14 +374,21 @@ func GetPlayer(req *http.Request) (interface{}, error) {
 	cid, _ := getUint64(session.Values["cid"])
 	roomId, _ := context.Get(req, "room_id").(uint64)
 
+	/* spectator has no player profile here */
+	if isSpectator(req) {
+		return nil, HTTPError(http.StatusNotFound)
+	}
+
 	reply, err := db.GetPlayerProfile(cid, roomId)
 	if err != nil {
 		return nil, HTTPError(http.StatusNotFound)
 	}
+	reply.Online = roomPresence(roomId).Players[reply.ID]
 
 	return reply, nil
 }
 
+/* Open to spectators */
 func GetPlayers(req *http.Request) (interface{}, error) {
 	roomId, _ := context.Get(req, "room_id").(uint64)
 
@@ -319,11 +397,90 @@ func GetPlayers(req *http.Request) (interface{}, error) {
 		return nil, HTTPError(http.StatusNotFound)
 	}
 
+	presence := roomPresence(roomId).Players
+	for i := range reply {
+		reply[i].Online = presence[reply[i].ID]
+	}
+
 	return reply, nil
 }
 
+/* Users watching the room, open to spectators */
+func GetSpectators(req *http.Request) (interface{}, error) {
+	roomId, _ := context.Get(req, "room_id").(uint64)
+
+	reply := []UserProfile{}
+	for id := range roomPresence(roomId).Spectators {
+		cid, _ := strconv.ParseUint(id, 10, 64)
+
+		profile, err := db.GetUserProfile(cid)
+		if err != nil {continue}
+
+		profile.Online = true
+		reply = append(reply, *profile)
+	}
+
+	return reply, nil
+}
+
+type spectatorsRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+/* Owner opens or closes the room for spectators */
+func SetSpectators(req *http.Request) (interface{}, error) {
+	session, _ := store.Get(req, "session")
+	cid, _ := getUint64(session.Values["cid"])
+	roomId, _ := context.Get(req, "room_id").(uint64)
+
+	if isSpectator(req) {
+		return nil, HTTPError(http.StatusForbidden)
+	}
+
+	var data spectatorsRequest
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			return nil, HTTPError(http.StatusBadRequest)
+		}
+	} else {
+		data.Enabled, _ = strconv.ParseBool(req.FormValue("enabled"))
+	}
+
+	room := Pool.Get(roomId)
+	defer room.Put()
+
+	sync := make(chan bool)
+	room.Post(&GameMessage {
+		CID: cid,
+		roomId: roomId,
+		spectate: &data.Enabled,
+		sync: sync,
+	})
+
+	if !<-sync {
+		return nil, HTTPError(http.StatusForbidden)
+	}
+
+	return &data, nil
+}
+
+/* Online players and spectators, empty if nobody is in the room */
+func roomPresence(roomId uint64) *Presence {
+	room := Pool.Lookup(roomId)
+	if room == nil {
+		return &Presence{}
+	}
+	defer room.Put()
+
+	return room.Online()
+}
+
 func RoomInvitation(req *http.Request) (interface{}, error) {
 	roomId, _ := context.Get(req, "room_id").(uint64)
+
+	if isSpectator(req) {
+		return nil, HTTPError(http.StatusForbidden)
+	}
 	token := randStr(20)
 
 	id, err := db.NewInvitation(roomId, token)
@@ -339,6 +496,62 @@ func RoomInvitation(req *http.Request) (interface{}, error) {
 	return &reply, nil
 }
 
+/* Page of room chat, ?before=<id>&limit=<n>. Open to spectators. */
+func GetChat(req *http.Request) (interface{}, error) {
+	roomId, _ := context.Get(req, "room_id").(uint64)
+
+	var before, limit uint64
+	if str := req.FormValue("before"); str != "" {
+		var err error
+		if before, err = strconv.ParseUint(str, 10, 64); err != nil {
+			return nil, HTTPError(http.StatusBadRequest)
+		}
+	}
+
+	limit, _ = strconv.ParseUint(req.FormValue("limit"), 10, 32)
+	if limit == 0 || limit > maxChatPage {
+		limit = chatHistorySize
+	}
+
+	reply, err := db.GetChat(roomId, before, uint(limit))
+	if err != nil {return nil, err}
+
+	if reply == nil {
+		reply = []ChatMessage{}
+	}
+	return reply, nil
+}
+
+/* Leave the room forfeiting the game in progress */
+func LeaveRoom(req *http.Request) (interface{}, error) {
+	session, _ := store.Get(req, "session")
+	cid, _ := getUint64(session.Values["cid"])
+	roomId, _ := context.Get(req, "room_id").(uint64)
+
+	if isSpectator(req) {
+		return nil, HTTPError(http.StatusForbidden)
+	}
+
+	room := Pool.Get(roomId)
+	defer room.Put()
+
+	sync := make(chan bool)
+	room.Post(&GameMessage {
+		CID: cid,
+		roomId: roomId,
+		Leave: []uint64{cid},
+		sync: sync,
+	})
+
+	if !<-sync {
+		return nil, HTTPError(http.StatusForbidden)
+	}
+
+	log.Printf("Player %d left room %d\n", cid, roomId)
+
+	return &leaveReply{Room: roomId, Status: "left"}, nil
+}
+
 type AuthData struct {
 	ID uint64
 }
@@ -364,58 +577,124 @@ func WebSocketServer(ws *websocket.Conn) {
 	cid, _ := getUint64(session.Values["cid"])
 	roomId, _ := context.Get(ws.Request(), "room_id").(uint64)
 	pid, _ := context.Get(ws.Request(), "player_id").(uint64)
+	spectator := isSpectator(ws.Request()) /* gets events read-only */
+
+	log.Printf("Connected cid %d to room %d as pid %d (spectator: %t)\n", cid, roomId, pid, spectator)
 
-	log.Printf("Connected cid %d to room %d as pid %d\n", cid, roomId, pid)
+	codec := newWireCodec(ws)
 
 	/* WebSocket reading wrapper */
-	incoming := make(chan *GameMessage)
+	incoming := make(chan []byte)
 	go func() {
 		for {
-			msg := new(GameMessage)
-			err := websocket.JSON.Receive(ws, msg)
+			data, err := codec.receive(ws)
 			if err != nil {
-				if err == io.EOF {
+				/* bad JSON is reported as malformed, anything else ends the connection */
+				if _, ok := err.(*json.SyntaxError); !ok {
+					if err != io.EOF {
+						log.Printf("Connection of cid %d: %s\n", cid, err.Error())
+					}
 					close(incoming)
 					return
 				}
-				/* skip unmarshalling errors */
-			} else {
-				incoming <- msg
+				data = nil
 			}
+			incoming <- data
 		}
 	}()
 
+	/* Handshake, legacy clients don't send hello. Binary subprotocol has no legacy shape. */
+	var (
+		version uint
+		first *GameMessage /* legacy message which came instead of hello */
+	)
+	if codec.binary {
+		version = ProtocolVersion
+	}
+
+	select {
+	case data, ok := <-incoming:
+		if !ok {return}
+
+		env, msg, err := codec.decode(data)
+		if err != nil || env.Type != KindHello {
+			first = msg
+			break
+		}
+
+		if version, err = negotiate(env.Version); err != nil {
+			codec.send(ws, &GameMessage{Error: err.Error()}, ProtocolVersion)
+			return
+		}
+
+		err = codec.send(ws, &GameMessage{kind: KindHello}, version)
+		if err != nil {return}
+
+	case <-time.After(time.Second * handshakeTimeout):
+	}
+
+	send := func(msg *GameMessage) error {
+		return codec.send(ws, msg, version)
+	}
+
 	room := Pool.Get(roomId)
 	defer room.Put()
 
-	client := room.NewClient(cid)
+	/* resuming client tells the last event it has seen */
+	since, _ := strconv.ParseUint(ws.Request().FormValue("seq"), 10, 64)
+
+	client := room.NewClient(cid, since, spectator)
 	defer client.Cancel()
 
+	post := func(msg *GameMessage) {
+		msg.CID = cid
+		msg.roomId = roomId
+		msg.sender = client
+
+		room.Post(msg)
+	}
+
+	if first != nil {
+		post(first)
+	}
+
 	timer := time.NewTimer(time.Second * keepAliveInterval)
 
 	keepalive := GameMessage {
 		Flags: FlagKeepAlive,
 	}
+
 	/* main loop */
 	for {
 		select {
-		case msg, ok := <-incoming:
+		case data, ok := <-incoming:
 			if !ok {return}
 
-			msg.CID = cid
-			msg.roomId = roomId
-			msg.sender = client
-
-			room.Post(msg)
 			timer.Reset(time.Second * keepAliveInterval)
 
-		case msg := <-client.msg:
-			err := websocket.JSON.Send(ws, msg)
+			/* both shapes are accepted during transition, hello and keepalive carry nothing */
+			env, msg, err := codec.decode(data)
+			if err != nil {
+				var ref string
+				if env != nil {
+					ref = env.ID
+				}
+				if err = send(errorMessage(err, ref)); err != nil {return}
+
+			} else if msg != nil {
+				post(msg)
+			}
+
+		case msg, ok := <-client.msg:
+			/* closed when spectating is turned off or the client falls behind */
+			if !ok {return}
+
+			err := send(msg)
 			if err != nil {return}
 			timer.Reset(time.Second * keepAliveInterval)
 
 		case <-timer.C:
-			err := websocket.JSON.Send(ws, &keepalive)
+			err := send(&keepalive)
 			if err != nil {return}
 			timer.Reset(time.Second * keepAliveInterval)
 		}
@@ -459,11 +738,19 @@ func main() {
 
 	/* Room API */
 	router.Path("/{room_id}/api/invitation").Methods("POST").Handler(NewAuthWrapper(JSONHandlerFunc(RoomInvitation), "/login/"))
+	router.Path("/{room_id}/api/chat").Methods("GET").Handler(NewAuthWrapper(JSONHandlerFunc(GetChat), "/login/"))
+	router.Path("/{room_id}/api/messages").Methods("POST").Handler(NewAuthWrapper(http.HandlerFunc(PostMessage), "/login/"))
+	router.Path("/{room_id}/api/leave").Methods("POST").Handler(NewAuthWrapper(JSONHandlerFunc(LeaveRoom), "/login/"))
+	router.Path("/{room_id}/api/spectators").Methods("GET").Handler(NewAuthWrapper(JSONHandlerFunc(GetSpectators), "/login/"))
+	router.Path("/{room_id}/api/spectators").Methods("POST").Handler(NewAuthWrapper(JSONHandlerFunc(SetSpectators), "/login/"))
 	router.Path("/{room_id}/api/users").Methods("GET").Handler(NewAuthWrapper(JSONHandlerFunc(GetPlayers), "/login/"))
 	router.Path("/{room_id}/api/users/{user_id}").Methods("GET").Handler(NewAuthWrapper(JSONHandlerFunc(GetPlayer), "/login/"))
 
 	/* Serve WebSocket */
-	router.Handle("/{room_id}/websocket", NewAuthWrapper(websocket.Handler(WebSocketServer), "/login/"))
+	router.Handle("/{room_id}/websocket", NewAuthWrapper(websocket.Server{Handshake: wsHandshake, Handler: WebSocketServer}, "/login/"))
+
+	/* Serve events stream for clients without WebSocket */
+	router.Path("/{room_id}/events").Methods("GET").Handler(NewAuthWrapper(http.HandlerFunc(EventStream), "/login/"))
 
 	http.Handle("/", router)
 	/* Start server */
@@ -0,0 +1,45 @@
+-- Schema changes on top of the original tables, apply in order
+
+-- Captured dots per player
+ALTER TABLE player ADD COLUMN score integer NOT NULL DEFAULT 0;
+
+-- Room options and game result
+ALTER TABLE room ADD COLUMN settings json;
+ALTER TABLE room ADD COLUMN status text NOT NULL DEFAULT 'active';
+ALTER TABLE room ADD COLUMN winner bigint;
+ALTER TABLE room ADD COLUMN final_score json;
+ALTER TABLE room ADD COLUMN reason text;
+ALTER TABLE room ADD COLUMN finished timestamp with time zone;
+
+-- Dots lost on grounding
+ALTER TABLE room ADD COLUMN grounded integer;
+
+-- Starting position dots belong to a seat (join order) instead of a client
+ALTER TABLE point ALTER COLUMN cid DROP NOT NULL;
+ALTER TABLE point ADD COLUMN seat integer;
+
+-- Clock state of timed games
+ALTER TABLE room ADD COLUMN clock json;
+
+-- Multi-player games: elimination time and final ranking
+ALTER TABLE player ADD COLUMN eliminated timestamp with time zone;
+ALTER TABLE room ADD COLUMN ranking json;
+
+-- Passed turns are kept in the game record
+ALTER TABLE point ADD COLUMN pass boolean NOT NULL DEFAULT false;
+
+-- Last event number for resuming clients
+ALTER TABLE room ADD COLUMN seq bigint NOT NULL DEFAULT 0;
+
+-- Players who left the room
+ALTER TABLE player ADD COLUMN departed timestamp with time zone;
+
+-- Room chat
+CREATE TABLE chat (
+	id serial PRIMARY KEY,
+	room_id bigint NOT NULL REFERENCES room (id) ON DELETE CASCADE,
+	cid bigint NOT NULL,
+	text text NOT NULL,
+	timestamp timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX chat_room_id ON chat (room_id, id);
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+	"math/rand"
+)
+
+/* Starting positions */
+const (
+	StartEmpty = ""
+	StartCross = "cross"
+	StartDoubleCross = "double-cross"
+	StartRandom = "random"
+)
+
+/* Dots per seat in random start, at most */
+const randomStartDots = 5
+
+/* Preset dot belongs to the player joined at given position, cid is known only after join */
+type SeatPoint struct {
+	Seat uint
+	Point
+}
+
+func crossAt(x, y uint) []SeatPoint {
+	return []SeatPoint {
+		{0, Point{x, y}},
+		{1, Point{x + 1, y}},
+		{0, Point{x + 1, y + 1}},
+		{1, Point{x, y + 1}},
+	}
+}
+
+/* Generate preset dots for new two player room, random ones are generated once and stored */
+func (s *RoomSettings) StartPoints() []SeatPoint {
+	cx, cy := s.Width / 2 - 1, s.Height / 2 - 1
+
+	switch s.Start {
+	case StartCross:
+		return crossAt(cx, cy)
+
+	case StartDoubleCross:
+		return append(crossAt(cx - 2, cy), crossAt(cx + 2, cy)...)
+
+	case StartRandom:
+		/* point symmetric pairs around the center, small boards get fewer of them */
+		pairs := [][2]Point{}
+		for y := s.Height / 4; y < s.Height / 4 + s.Height / 2; y++ {
+			for x := s.Width / 4; x < s.Width / 4 + s.Width / 2; x++ {
+				p := Point{x, y}
+				q := Point{s.Width - 1 - x, s.Height - 1 - y}
+				if p.Y < q.Y || (p.Y == q.Y && p.X < q.X) {
+					pairs = append(pairs, [2]Point{p, q})
+				}
+			}
+		}
+
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		points := []SeatPoint{}
+		for _, i := range rnd.Perm(len(pairs)) {
+			if len(points) == randomStartDots * 2 {break}
+			points = append(points, SeatPoint{0, pairs[i][0]}, SeatPoint{1, pairs[i][1]})
+		}
+		return points
+	}
+
+	return nil
+}
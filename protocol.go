@@ -0,0 +1,250 @@
+package main
+
+import (
+	"time"
+	"errors"
+	"net/http"
+	"encoding/json"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+/* Envelope versions understood by the server. Version 0 is the legacy bare GameMessage. */
+const (
+	minProtocolVersion = 1
+	ProtocolVersion = 1
+	handshakeTimeout = 2 /* sec to wait for client hello before falling back to legacy */
+	rateLimit = 10 /* client messages per second, whatever transport they come by */
+)
+
+/* Message kinds */
+const (
+	KindHello = "hello" /* version handshake, first message in both directions */
+	KindHistory = "history" /* whole room state */
+	KindMove = "move"
+	KindAction = "action"
+	KindPlayers = "players" /* join or color scheme change */
+	KindPresence = "presence" /* players or spectators going online or offline */
+	KindSettings = "settings" /* room options changed */
+	KindLeave = "leave"
+	KindChat = "chat"
+	KindState = "state" /* computed state after move, action or flag fall */
+	KindKeepAlive = "keepalive"
+	KindError = "error"
+)
+
+/* Error reply codes */
+const (
+	ErrCodeMalformed = "malformed" /* not a valid message */
+	ErrCodeProtocol = "protocol" /* version or kind mismatch */
+	ErrCodeIllegal = "illegal" /* refused by game rules */
+	ErrCodePermission = "permission"
+	ErrCodeRateLimit = "rate-limit"
+	ErrCodeInternal = "internal" /* server failure, message may be sent again */
+)
+
+var (
+	ErrNullOrigin = errors.New("null origin")
+	ErrProtocolVersion = errors.New("unsupported protocol version")
+	ErrMessageKind = errors.New("unexpected message kind")
+	ErrRateLimit = errors.New("too many messages")
+)
+
+type Envelope struct {
+	Type string `json:"type"`
+	Version uint `json:"version,omitempty"`
+	ID string `json:"id,omitempty"` /* client message id, referenced by error replies */
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+/* Client messages counted in one second window */
+type rateLimiter struct {
+	window time.Time
+	received int
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if now.Sub(l.window) >= time.Second {
+		l.window, l.received = now, 0
+	}
+	l.received++
+	return l.received <= rateLimit
+}
+
+/* Classify error for the reply */
+func errorCode(err error) string {
+	switch err {
+	case ErrProtocolVersion, ErrMessageKind:
+		return ErrCodeProtocol
+	case ErrNotPlayer, ErrEliminated, ErrRoomFull, ErrDeparted, ErrSpectator, ErrNotOwner, ErrNoSpectators:
+		return ErrCodePermission
+	case ErrRateLimit:
+		return ErrCodeRateLimit
+	case ErrMalformed, ErrMixedMessage:
+		return ErrCodeMalformed
+	case ErrStorage:
+		return ErrCodeInternal
+	}
+
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return ErrCodeMalformed
+	}
+	return ErrCodeIllegal
+}
+
+/* Error reply to the client message with given id */
+func errorMessage(err error, ref string) *GameMessage {
+	return &GameMessage {
+		Error: err.Error(),
+		Code: errorCode(err),
+		Ref: ref,
+	}
+}
+
+/* Explicit kind or the one implied by message contents */
+func (msg *GameMessage) Kind() string {
+	switch {
+	case msg.kind != "":
+		return msg.kind
+	case msg.Flags & FlagKeepAlive != 0:
+		return KindKeepAlive
+	case msg.Error != "":
+		return KindError
+	case len(msg.Points) != 0:
+		return KindMove
+	case msg.Action != "":
+		return KindAction
+	case len(msg.Chat) != 0:
+		return KindChat
+	case len(msg.Leave) != 0:
+		return KindLeave
+	case len(msg.Players) != 0:
+		return KindPlayers
+	case len(msg.Presence) != 0, len(msg.Spectators) != 0:
+		return KindPresence
+	case msg.Settings != nil:
+		return KindSettings
+	}
+	return KindState
+}
+
+/* Wrap message for the negotiated version, legacy clients get it as is */
+func encodeMessage(msg *GameMessage, version uint) (interface{}, error) {
+	if version == 0 {return msg, nil}
+	if msg.Kind() == KindHello {return &Envelope{Type: KindHello, Version: version}, nil}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {return nil, err}
+
+	return &Envelope {
+		Type: msg.Kind(),
+		Version: version,
+		Payload: payload,
+	}, nil
+}
+
+/* Parse client message of either shape. Hello carries no payload and is returned as is. */
+func decodeMessage(data []byte) (*Envelope, *GameMessage, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {return nil, nil, err}
+
+	msg := new(GameMessage)
+
+	/* legacy */
+	if env.Type == "" {
+		if err := json.Unmarshal(data, msg); err != nil {return &env, nil, err}
+		return &env, msg, nil
+	}
+
+	if len(env.Payload) != 0 && env.Type != KindHello {
+		if err := json.Unmarshal(env.Payload, msg); err != nil {return &env, nil, err}
+	}
+
+	return checkEnvelope(&env, msg)
+}
+
+/* Version and kind checks shared by the encodings, msg holds the payload */
+func checkEnvelope(env *Envelope, msg *GameMessage) (*Envelope, *GameMessage, error) {
+	/* version is negotiated by hello itself */
+	if env.Type == KindHello {return env, nil, nil}
+
+	if env.Version < minProtocolVersion || env.Version > ProtocolVersion {return env, nil, ErrProtocolVersion}
+
+	switch env.Type {
+	case KindKeepAlive:
+		return env, nil, nil
+
+	case KindMove, KindAction, KindPlayers, KindLeave, KindChat:
+		if msg.ID == "" {
+			msg.ID = env.ID
+		}
+		if msg.Kind() != env.Type {return env, nil, ErrMessageKind}
+		return env, msg, nil
+	}
+
+	return env, nil, ErrMessageKind
+}
+
+/* Version to speak with client offering given one */
+func negotiate(version uint) (uint, error) {
+	if version < minProtocolVersion {return 0, ErrProtocolVersion}
+	if version > ProtocolVersion {return ProtocolVersion, nil}
+	return version, nil
+}
+
+/* Pick binary subprotocol if offered, JSON otherwise. Origin is checked like in default handler. */
+func wsHandshake(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err != nil {return err}
+	if config.Origin == nil {return ErrNullOrigin}
+
+	offered := config.Protocol
+	config.Protocol = nil
+	for _, p := range offered {
+		if p == BinaryProtocol {
+			config.Protocol = []string{p}
+		}
+	}
+	return nil
+}
+
+/* Message encoding of a websocket connection */
+type wireCodec struct {
+	binary bool
+}
+
+func newWireCodec(ws *websocket.Conn) wireCodec {
+	protocol := ws.Config().Protocol
+	return wireCodec{len(protocol) == 1 && protocol[0] == BinaryProtocol}
+}
+
+/* Next frame, JSON syntax errors are returned as such */
+func (c wireCodec) receive(ws *websocket.Conn) ([]byte, error) {
+	if c.binary {
+		var data []byte
+		err := websocket.Message.Receive(ws, &data)
+		return data, err
+	}
+
+	var data json.RawMessage
+	err := websocket.JSON.Receive(ws, &data)
+	return data, err
+}
+
+func (c wireCodec) send(ws *websocket.Conn, msg *GameMessage, version uint) error {
+	if c.binary {
+		data, err := encodeBinary(msg, version)
+		if err != nil {return err}
+		return websocket.Message.Send(ws, data)
+	}
+
+	data, err := encodeMessage(msg, version)
+	if err != nil {return err}
+	return websocket.JSON.Send(ws, data)
+}
+
+func (c wireCodec) decode(data []byte) (*Envelope, *GameMessage, error) {
+	if c.binary {return decodeBinary(data)}
+	return decodeMessage(data)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+)
+
+const defaultRules = "classic"
+
+var ErrUnknownRules = errors.New("unknown ruleset")
+
+/* Game variant consulted by Board and Game */
+type Ruleset interface {
+	/* Extra legality check, node is known to be free and inside the board */
+	CanPlace(b *Board, cid uint64, p Point) error
+
+	/* Whether closed region around cid's dots becomes cid's area */
+	Capture(b *Board, cid uint64, nodes []int) bool
+
+	Score(b *Board, cid uint64) uint
+}
+
+/* Region is captured only if there are enemy dots inside, score is captured dots count */
+type ClassicRules struct{}
+
+func (r ClassicRules) CanPlace(b *Board, cid uint64, p Point) error {
+	return nil
+}
+
+func (r ClassicRules) Capture(b *Board, cid uint64, nodes []int) bool {
+	return b.hasEnemies(cid, nodes)
+}
+
+func (r ClassicRules) Score(b *Board, cid uint64) uint {
+	return b.Captured(cid)
+}
+
+/* Every closed region becomes area, empty ones included, and score is the surrounded territory.
+Empty base option has no effect since empty regions are taken at once. */
+type TerritoryRules struct {
+	ClassicRules
+}
+
+func (r TerritoryRules) Capture(b *Board, cid uint64, nodes []int) bool {
+	return true
+}
+
+func (r TerritoryRules) Score(b *Board, cid uint64) uint {
+	return b.Territory(cid)
+}
+
+var rulesets = map[string]Ruleset {
+	"classic": ClassicRules{},
+	"territory": TerritoryRules{},
+}
+
+func LookupRules(name string) (Ruleset, error) {
+	if name == "" {
+		name = defaultRules
+	}
+
+	rules, ok := rulesets[name]
+	if !ok {return nil, ErrUnknownRules}
+
+	return rules, nil
+}
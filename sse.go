@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"fmt"
+	"log"
+	"time"
+	"strconv"
+	"net/http"
+	"encoding/json"
+
+	"github.com/gorilla/context"
+)
+
+/*
+Fallback transport for clients behind proxies which drop websockets.
+Room events come as Server-Sent Events, client messages are posted over plain HTTP.
+Both speak the JSON envelope of the latest protocol version.
+*/
+
+const maxPostSize = 64 << 10
+
+/* HTTP status for the error reply code */
+func errorStatus(code string) int {
+	switch code {
+	case ErrCodePermission:
+		return http.StatusForbidden
+	case ErrCodeIllegal:
+		return http.StatusConflict
+	case ErrCodeInternal:
+		return http.StatusInternalServerError
+	case ErrCodeRateLimit:
+		return 429 /* Too Many Requests */
+	}
+	return http.StatusBadRequest
+}
+
+/* Room events stream. Browser resumes it by itself sending the last event id. */
+func EventStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(req, "session")
+
+	cid, _ := getUint64(session.Values["cid"])
+	roomId, _ := context.Get(req, "room_id").(uint64)
+	spectator := isSpectator(req) /* gets events read-only */
+
+	since, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+	if since == 0 {
+		since, _ = strconv.ParseUint(req.FormValue("seq"), 10, 64)
+	}
+
+	log.Printf("Streaming room %d to cid %d (spectator: %t)\n", roomId, cid, spectator)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") /* nginx */
+
+	send := func(msg *GameMessage) error {
+		env, err := encodeMessage(msg, ProtocolVersion)
+		if err != nil {return err}
+
+		data, err := json.Marshal(env)
+		if err != nil {return err}
+
+		/* only recorded events can be resumed from */
+		if msg.Seq != 0 {
+			if _, err = fmt.Fprintf(w, "id: %d\n", msg.Seq); err != nil {return err}
+		}
+		if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {return err}
+
+		flusher.Flush()
+		return nil
+	}
+
+	/* no handshake, client learns the version from the first event */
+	if err := send(&GameMessage{kind: KindHello}); err != nil {return}
+
+	room := Pool.Get(roomId)
+	defer room.Put()
+
+	client := room.NewClient(cid, since, spectator)
+	defer client.Cancel()
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	timer := time.NewTimer(time.Second * keepAliveInterval)
+
+	keepalive := GameMessage {
+		Flags: FlagKeepAlive,
+	}
+
+	for {
+		select {
+		case msg, ok := <-client.msg:
+			/* closed when spectating is turned off or the client falls behind */
+			if !ok {return}
+
+			err := send(msg)
+			if err != nil {return}
+			timer.Reset(time.Second * keepAliveInterval)
+
+		case <-timer.C:
+			err := send(&keepalive)
+			if err != nil {return}
+			timer.Reset(time.Second * keepAliveInterval)
+
+		case <-closed:
+			return
+		}
+	}
+}
+
+/* Client message posted over HTTP, goes to the room the same way as a websocket one */
+func PostMessage(w http.ResponseWriter, req *http.Request) {
+	session, _ := store.Get(req, "session")
+
+	cid, _ := getUint64(session.Values["cid"])
+	roomId, _ := context.Get(req, "room_id").(uint64)
+	spectator := isSpectator(req)
+
+	reply := func(msg *GameMessage) {
+		env, err := encodeMessage(msg, ProtocolVersion)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(msg.Code))
+		_ = json.NewEncoder(w).Encode(env)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxPostSize))
+	if err != nil {
+		reply(errorMessage(err, ""))
+		return
+	}
+
+	env, msg, err := decodeMessage(data)
+	if err != nil {
+		var ref string
+		if env != nil {
+			ref = env.ID
+		}
+		reply(errorMessage(err, ref))
+		return
+	}
+
+	/* hello and keepalive mean nothing here */
+	if msg == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if spectator {
+		reply(errorMessage(ErrSpectator, env.ID))
+		return
+	}
+
+	room := Pool.Get(roomId)
+	defer room.Put()
+
+	sender := room.NewSender(cid, spectator)
+	sync := make(chan bool)
+
+	msg.CID = cid
+	msg.roomId = roomId
+	msg.sender = sender
+	msg.sync = sync
+
+	room.Post(msg)
+	if !<-sync {
+		reply(<-sender.msg)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -489,26 +489,17 @@ window.Controllers = window.Controllers || {};
 
 		this.cid = window.AuthData.ID;
 		this.canvas = $('#board');
-
-		this.canvasW = this.canvas.width() - this.style.board.padding * 2 - 1;
-		this.gridStep = this.canvasW / (this.xnodes - 1);
-		this.canvasH = this.gridStep * (this.ynodes - 1);
-
-		this.canvas.attr("height", Math.round(this.canvasH + this.style.board.padding * 2 + 1));
-		ensureHIDPI(this.canvas.get(0));
-
-		this.freeNodes = this.xnodes * this.ynodes;
+		this.canvasWidth = this.canvas.width();
 
 		this.points = {};
 		this.areas = {};
-		this.map = [];
 		this.areasMaps = [];
+		this.pending = {}; /* moves sent but not yet accepted, by message id */
 
 		this.players = {};
 		this.players[this.cid] = this.randomScheme();
 
-		_.times(this.ynodes, function(n){this.map[n] = [];}, this);
-
+		this.setSize(this.xnodes, this.ynodes);
 		this.renderGame();
 		this.setupConn();
 		this.canvas.click(_.bind(this.canvasClick, this));
@@ -517,6 +508,12 @@ window.Controllers = window.Controllers || {};
 	_.extend(Game.App.prototype, Backbone.Events, {
 		/* Flags*/
 		FL_KEEPALIVE: 0x1,
+		FL_RESET: 0x2,
+
+		/* Envelope protocol version */
+		PROTOCOL_VERSION: 1,
+		RECONNECT_DELAY: 3000,
+		CONN_OPEN: 1, /* same for WebSocket and EventSource */
 			
 		randomScheme: function() {
 			var styles = _.difference(_.keys(this.style.schemes), _.values(this.players));
@@ -530,8 +527,37 @@ window.Controllers = window.Controllers || {};
 
 		onMessage: function(evt) {
 			var msg = JSON.parse(evt.data);
+
+			/* unwrap envelope */
+			if(msg.type !== undefined) {
+				if(msg.type == "hello") {
+					this.protocol = msg.version;
+					return;
+				}
+				msg = msg.payload || {};
+			}
+
+			if(msg.seq) this.seq = msg.seq;
 			if(!(msg.fl & this.FL_KEEPALIVE)) console.log(msg);
 
+			/* whole game follows */
+			if(msg.fl & this.FL_RESET) {
+				this.points = {};
+				this.areas = {};
+				this.areasMaps = [];
+				this.map = [];
+				_.times(this.ynodes, function(n){this.map[n] = [];}, this);
+				this.pending = {};
+				this.renderGame();
+			}
+
+			/* board size chosen at room creation */
+			if(msg.settings && (msg.settings.width != this.xnodes || msg.settings.height != this.ynodes)) {
+				this.setSize(msg.settings.width, msg.settings.height);
+				this.renderGame();
+				this.trigger("change:free", this.freeNodes);
+			}
+
 			if(msg.players) {
 				_.each(msg.players, function(scheme, cid) {
 					if(scheme !== "") {
@@ -548,13 +574,69 @@ window.Controllers = window.Controllers || {};
 				}, this);
 			}
 
-			/* TODO leave */
+			if(msg.presence) {
+				_.each(msg.presence, function(online, cid) {
+					this.trigger("change:presence", {
+						id: String(cid),
+						online: online
+					});
+				}, this);
+			}
+
+			if(msg.spectators) {
+				_.each(msg.spectators, function(watching, cid) {
+					this.trigger("change:spectator", {
+						id: String(cid),
+						watching: watching
+					});
+				}, this);
+			}
+
+			if(msg.chat) {
+				_.each(msg.chat, function(c) {
+					this.trigger("chat", c);
+				}, this);
+			}
+
+			if(msg.leave) {
+				_.each(msg.leave, function(cid) {
+					this.trigger("leave", String(cid));
+				}, this);
+			}
 			
-			/* TODO turn */
+			if(msg.turn !== undefined) this.turn = msg.turn;
+
+			if(msg.error) {
+				this.displayAlert(msg.error);
+				if(msg.ref) this.takeBack(msg.ref);
+			}
+
+			if(msg.action == "pass" && msg.cid != this.cid) this.displayAlert("Opponent passed");
+
+			/* pending offers, missing ones are withdrawn */
+			if(msg.offers) {
+				var prev = this.offers || {};
+				if(msg.offers.draw && !prev.draw && msg.offers.draw.from != this.cid) this.displayAlert("Draw offered");
+				if(msg.offers.undo && !prev.undo && msg.offers.undo.from != this.cid) this.displayAlert("Undo requested");
+				this.offers = msg.offers;
+			}
+
+			if(msg.eliminated && _.contains(msg.eliminated, String(this.cid)) && !msg.result) {
+				this.displayAlert("You are out of the game");
+			}
+
+			if(msg.result) {
+				this.result = msg.result;
+				this.displayAlert(!msg.result.winner ? "Draw" : (msg.result.winner == this.cid ? "You won" : "You lost"));
+			}
 
 			if(msg.p) {
 				_.each(msg.p, function(points, cid) {
 					_.each(points, function(p) {
+						/* our own move is accepted */
+						if(cid == this.cid) {
+							this.pending = _.omit(this.pending, function(m) {return m.pos.x == p.x && m.pos.y == p.y;});
+						}
 						this.addPoint(p, cid, {
 							updateAreas: false,
 							render: false
@@ -574,20 +656,90 @@ window.Controllers = window.Controllers || {};
 			if(msg.p || msg.a || msg.players) this.renderGame();
 		},
 
+		setSize: function(xnodes, ynodes) {
+			this.xnodes = xnodes;
+			this.ynodes = ynodes;
+
+			/* undo HIDPI scaling */
+			this.canvas.css({width: "", height: ""});
+			this.canvas.attr("width", this.canvasWidth);
+
+			this.canvasW = this.canvasWidth - this.style.board.padding * 2 - 1;
+			this.gridStep = this.canvasW / (this.xnodes - 1);
+			this.canvasH = this.gridStep * (this.ynodes - 1);
+
+			this.canvas.attr("height", Math.round(this.canvasH + this.style.board.padding * 2 + 1));
+			ensureHIDPI(this.canvas.get(0));
+
+			this.freeNodes = this.xnodes * this.ynodes;
+
+			this.map = [];
+			_.times(this.ynodes, function(n){this.map[n] = [];}, this);
+		},
+
 		displayAlert: function(msg) {
 			$(".alert").html("<h3>" + msg + "</h3>");
 		},
 
+		roomPath: function() {
+			var path = window.location.pathname;
+			return path[path.length - 1] != "/" ? path + "/" : path;
+		},
+
 		setupConn: function() {
+			/* proxy killed websocket before, don't try again */
+			if(this.useEvents || typeof WebSocket === "undefined") {
+				this.setupEvents();
+				return;
+			}
+
 			var loc = window.location;
 			var proto = loc.protocol == "https:" ? "wss:" : "ws:";
 
-			this.conn = new WebSocket(proto + "//" + loc.host + loc.pathname +
-					(loc.pathname[loc.pathname.length - 1] != "/" ? "/" : "") +
-					"websocket");
+			/* resume from the last seen event */
+			this.conn = new WebSocket(proto + "//" + loc.host + this.roomPath() +
+					"websocket" + (this.seq ? "?seq=" + this.seq : ""));
 			var self = this;
+			var opened = false;
 			this.conn.onclose = function() {
+				if(!opened) {
+					self.useEvents = true;
+				}
 				self.displayAlert("Connection closed");
+				setTimeout(_.bind(self.setupConn, self), self.RECONNECT_DELAY);
+			};
+
+			this.conn.onopen = function() {
+				opened = true;
+				self.conn.send(JSON.stringify({type: "hello", version: self.PROTOCOL_VERSION}));
+			};
+
+			this.conn.onmessage = _.bind(this.onMessage, this);
+		},
+
+		/* Server-Sent Events with messages posted over HTTP, looks like WebSocket to the rest */
+		setupEvents: function() {
+			var path = this.roomPath();
+			var self = this;
+
+			/* browser reconnects by itself sending the last event id */
+			this.conn = new EventSource(path + "events" + (this.seq ? "?seq=" + this.seq : ""));
+			this.conn.send = function(data) {
+				$.ajax({
+					type: "POST",
+					url: path + "api/messages",
+					data: data,
+					contentType: "application/json",
+					processData: false
+				}).fail(function(xhr) {
+					if(xhr.responseText) self.onMessage({data: xhr.responseText});
+				});
+			};
+
+			this.conn.onerror = function() {
+				if(self.conn.readyState == EventSource.CLOSED) {
+					self.displayAlert("Connection closed");
+				}
 			};
 
 			this.conn.onmessage = _.bind(this.onMessage, this);
@@ -784,7 +936,11 @@ window.Controllers = window.Controllers || {};
 		},
 
 		newPoint: function(pos) {
-			if(this.conn && this.conn.readyState == WebSocket.OPEN && this.addPoint(pos, this.cid)) {
+			/* the server refuses it anyway */
+			if(this.turn != this.cid) return;
+
+			var areas = this.copyAreas();
+			if(this.conn && this.conn.readyState == this.CONN_OPEN && this.addPoint(pos, this.cid)) {
 				var msg = {
 					p: new MsgMap({cid: this.cid, data: [pos]})
 				};
@@ -803,11 +959,54 @@ window.Controllers = window.Controllers || {};
 					if(upd) this.renderGame();
 				}
 				this.updFreeNodes();
-				this.sendMsg(msg);
+				this.sendMsg("move", msg);
+
+				/* until the server accepts or refuses it */
+				this.pending[msg.id] = {pos: pos, areas: areas};
+			}
+		},
+
+		copyAreas: function() {
+			var areas = {};
+			_.each(this.areas, function(bands, cid) {
+				areas[cid] = bands.slice();
+			});
+			return areas;
+		},
+
+		/* remove the refused dot and areas built with it */
+		takeBack: function(id) {
+			var m = this.pending[id];
+			if(!m) return;
+			delete this.pending[id];
+
+			this.points[this.cid] = _.reject(this.points[this.cid], function(p) {return p.x == m.pos.x && p.y == m.pos.y;});
+			this.map[m.pos.y][m.pos.x] = undefined;
+
+			this.areas = m.areas;
+			this.areasMaps = [];
+			_.each(this.areas, function(b, cid) {
+				this.updateAreasMap(cid);
+			}, this);
+
+			this.updFreeNodes();
+			this.renderGame();
+		},
+
+		sendChat: function(text) {
+			if(this.conn && this.conn.readyState == this.CONN_OPEN) {
+				this.sendMsg("chat", {chat: [{text: text}]});
 			}
 		},
 
-		sendMsg: function(msg) {
+		sendMsg: function(type, msg) {
+			/* errors refer to it */
+			this.msgId = (this.msgId || 0) + 1;
+			msg.id = String(this.msgId);
+
+			if(this.protocol) {
+				msg = {type: type, version: this.protocol, id: msg.id, payload: msg};
+			}
 			this.conn.send(JSON.stringify(msg));
 		},
 
@@ -911,7 +1110,7 @@ window.Controllers = window.Controllers || {};
 		},
 
 		destroy: function() {
-			if(this.conn && this.conn.readyState == WebSocket.OPEN) {
+			if(this.conn && this.conn.readyState == this.CONN_OPEN) {
 				this.conn.onclose = null;
 				this.conn.close();
 			}
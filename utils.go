@@ -4,6 +4,7 @@ import (
 	"log"
 	"strconv"
 	"net/http"
+	"database/sql"
 	"encoding/json"
 	"crypto/rand"
 	"encoding/base64"
@@ -89,13 +90,28 @@ func (wrapper *AuthWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		pid, err := db.GetPlayer(roomId, cid)
 
-		if err != nil {
+		/* non-players may watch if the room allows, players who left don't come back as spectators */
+		spectator := false
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			settings, e := db.GetRoomSettings(roomId)
+			if e != nil || !settings.Spectators {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			spectator = true
+		case ErrDeparted:
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
 
 		context.Set(r, "room_id", roomId)
 		context.Set(r, "player_id", pid)
+		context.Set(r, "spectator", spectator)
 	}
 
 	/* update cookie expiration date */
@@ -110,6 +126,12 @@ func NewAuthWrapper(handler http.Handler, redirect string) *AuthWrapper {
 	return &AuthWrapper{Handler: handler, Redirect: redirect}
 }
 
+/* Non-player let in by AuthWrapper to watch the room */
+func isSpectator(req *http.Request) bool {
+	spectator, _ := context.Get(req, "spectator").(bool)
+	return spectator
+}
+
 /*-------------------------------------------------------------------------------*/
 
 func randStr(n uint) string {
@@ -146,3 +168,9 @@ func getUint64 (v interface{}) (uint64, bool) {
 
 	return ret, true
 }
+
+/* cid as map key / JSON string, empty for none */
+func formatCID(cid uint64) string {
+	if cid == 0 {return ""}
+	return strconv.FormatUint(cid, 10)
+}